@@ -5,14 +5,24 @@ import (
 	"core/proto"
 )
 
+var GetQuote func(proto.QuoteRequest) (proto.Quote, error)
+var GetOrderLimits func(currency string) ([]proto.OrderLimit, error)
+var ListPaymentMethods func(currency string) ([]proto.PaymentMethod, error)
 var CreateOrder func(proto.Order) (proto.Order, error)
 var CancelOrder func(orderID uint64) (bool, error)
 var GetOrder func(orderID uint64) (proto.Order, error)
 var MarkPayed func(orderID uint64) (bool, error)
+var OpenDispute func(proto.OpenDisputeRequest) (proto.Order, error)
+var GetRates func(currency string) ([]proto.Rate, error)
 
 func init() {
+	rabbit.DeclareRPC(proto.GetQuote, &GetQuote)
+	rabbit.DeclareRPC(proto.GetOrderLimits, &GetOrderLimits)
+	rabbit.DeclareRPC(proto.ListPaymentMethods, &ListPaymentMethods)
 	rabbit.DeclareRPC(proto.CreateOrder, &CreateOrder)
 	rabbit.DeclareRPC(proto.CancelOrder, &CancelOrder)
 	rabbit.DeclareRPC(proto.GetOrder, &GetOrder)
 	rabbit.DeclareRPC(proto.MarkPayed, &MarkPayed)
+	rabbit.DeclareRPC(proto.OpenDispute, &OpenDispute)
+	rabbit.DeclareRPC(proto.GetRates, &GetRates)
 }
@@ -5,6 +5,7 @@ import (
 	"common/rabbit"
 	"common/soso"
 	"core/proto"
+	"sync"
 )
 
 func init() {
@@ -15,10 +16,29 @@ func init() {
 		Prefetch:       10,
 		DecodedHandler: OrderEventHandler,
 	})
+	rabbit.Subscribe(rabbit.Subscription{
+		Name:           "order_warning",
+		Routes:         []rabbit.Route{proto.OrderWarningRoute},
+		AutoAck:        true,
+		Prefetch:       10,
+		DecodedHandler: OrderWarningHandler,
+	})
+	rabbit.Subscribe(rabbit.Subscription{
+		Name:           "rate_event",
+		Routes:         []rabbit.Route{proto.RateEventRoute},
+		AutoAck:        true,
+		Prefetch:       10,
+		DecodedHandler: RateEventHandler,
+	})
 }
 
+var orderEvents = proto.NewEventSequencer(10000)
+
 func OrderEventHandler(order proto.Order) bool {
 	log.Debug("order event: %+v", order)
+	if orderEvents.Stale(order.ID, order.EventSeq) {
+		return true
+	}
 	ctx := soso.NewRemoteContext("order", "event", map[string]interface{}{
 		"order": order,
 	})
@@ -29,3 +49,86 @@ func OrderEventHandler(order proto.Order) bool {
 	}
 	return true
 }
+
+var orderWarnings = proto.NewEventSequencer(10000)
+
+func OrderWarningHandler(warning proto.OrderWarning) bool {
+	log.Debug("order warning: %+v", warning)
+	if orderWarnings.Stale(warning.OrderID, warning.Seq) {
+		return true
+	}
+	ctx := soso.NewRemoteContext("order", "warning", map[string]interface{}{
+		"warning": warning,
+	})
+	sess := soso.Sessions.Get(IDForAddress(warning.Destination))
+	for _, ses := range sess {
+		ctx.Session = ses
+		ctx.SendResponse()
+	}
+	return true
+}
+
+// Users subscribed to rates through rates/subscribe and their currencies.
+// Users without open sessions are forgotten on next event.
+type RateSubscriptions struct {
+	mutex sync.Mutex
+	// Empty set means every currency
+	users map[uint64]map[string]bool
+}
+
+var rateSubscriptions = &RateSubscriptions{users: map[uint64]map[string]bool{}}
+
+func (s *RateSubscriptions) Subscribe(uid uint64, currencies []string) {
+	set := map[string]bool{}
+	for _, currency := range currencies {
+		set[currency] = true
+	}
+	s.mutex.Lock()
+	s.users[uid] = set
+	s.mutex.Unlock()
+}
+
+func (s *RateSubscriptions) Wants(uid uint64, currency string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	set, ok := s.users[uid]
+	return ok && (len(set) == 0 || set[currency])
+}
+
+// Returns users interested in currency
+func (s *RateSubscriptions) Users(currency string) []uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var ret []uint64
+	for uid, set := range s.users {
+		if len(set) == 0 || set[currency] {
+			ret = append(ret, uid)
+		}
+	}
+	return ret
+}
+
+func (s *RateSubscriptions) Forget(uid uint64) {
+	s.mutex.Lock()
+	delete(s.users, uid)
+	s.mutex.Unlock()
+}
+
+func RateEventHandler(rate proto.Rate) bool {
+	log.Debug("rate event: %+v", rate)
+	ctx := soso.NewRemoteContext("rates", "event", map[string]interface{}{
+		"rate": rate,
+	})
+	for _, uid := range rateSubscriptions.Users(rate.Currency) {
+		sess := soso.Sessions.Get(uid)
+		if len(sess) == 0 {
+			rateSubscriptions.Forget(uid)
+			continue
+		}
+		for _, ses := range sess {
+			ctx.Session = ses
+			ctx.SendResponse()
+		}
+	}
+	return true
+}
@@ -10,6 +10,21 @@ import (
 )
 
 var SosoRoutes = []soso.Route{
+	{
+		Domain:  "quote",
+		Method:  "get",
+		Handler: GetQuoteHandler,
+	},
+	{
+		Domain:  "limits",
+		Method:  "get",
+		Handler: GetLimitsHandler,
+	},
+	{
+		Domain:  "payment_methods",
+		Method:  "list",
+		Handler: ListPaymentMethodsHandler,
+	},
 	{
 		Domain:  "order",
 		Method:  "create",
@@ -30,6 +45,21 @@ var SosoRoutes = []soso.Route{
 		Method:  "mark_payed",
 		Handler: MarkPayedHandler,
 	},
+	{
+		Domain:  "order",
+		Method:  "dispute",
+		Handler: OpenDisputeHandler,
+	},
+	{
+		Domain:  "rates",
+		Method:  "get",
+		Handler: GetRatesHandler,
+	},
+	{
+		Domain:  "rates",
+		Method:  "subscribe",
+		Handler: SubscribeRatesHandler,
+	},
 }
 
 func GetOrderHandler(c *soso.Context, arg *struct {
@@ -61,12 +91,81 @@ func GetOrderHandler(c *soso.Context, arg *struct {
 	c.SuccessResponse(order)
 }
 
+func GetQuoteHandler(c *soso.Context, arg *struct {
+	PaymentMethod string          `json:"payment_method"`
+	Currency      string          `json:"currency"`
+	FiatAmount    decimal.Decimal `json:"fiat_amount"`
+}) {
+	if arg.PaymentMethod == "" || arg.Currency == "" || arg.FiatAmount.Sign() <= 0 {
+		c.ErrorResponse(http.StatusBadRequest, soso.LevelError, errors.New("bad request"))
+		return
+	}
+
+	quote, err := GetQuote(proto.QuoteRequest{
+		Currency:      arg.Currency,
+		FiatAmount:    arg.FiatAmount,
+		PaymentMethod: arg.PaymentMethod,
+	})
+
+	if err != nil {
+		err := err.(rabbit.RPCError)
+		if err.Kind != rabbit.RPCError_Forwarded {
+			c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, errors.New("service unavailable"))
+			return
+		}
+		c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, err)
+		return
+	}
+
+	c.SuccessResponse(quote)
+}
+
+func GetLimitsHandler(c *soso.Context, arg *struct {
+	// Optional, limits for every currency will be returned if empty
+	Currency string `json:"currency"`
+}) {
+	limits, err := GetOrderLimits(arg.Currency)
+
+	if err != nil {
+		err := err.(rabbit.RPCError)
+		if err.Kind != rabbit.RPCError_Forwarded {
+			c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, errors.New("service unavailable"))
+			return
+		}
+		c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, err)
+		return
+	}
+
+	c.SuccessResponse(limits)
+}
+
+func ListPaymentMethodsHandler(c *soso.Context, arg *struct {
+	// Optional, every method will be returned if empty
+	Currency string `json:"currency"`
+}) {
+	methods, err := ListPaymentMethods(arg.Currency)
+
+	if err != nil {
+		err := err.(rabbit.RPCError)
+		if err.Kind != rabbit.RPCError_Forwarded {
+			c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, errors.New("service unavailable"))
+			return
+		}
+		c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, err)
+		return
+	}
+
+	c.SuccessResponse(methods)
+}
+
 func CreateOrderHandler(c *soso.Context, arg *struct {
 	ClientName    string          `json:"client_name"`
 	Address       string          `json:"address"`
 	PaymentMethod string          `json:"payment_method"`
 	Currency      string          `json:"currency"`
 	FiatAmount    decimal.Decimal `json:"fiat_amount"`
+	// Optional
+	QuoteID uint64 `json:"quote_id"`
 }) {
 	if arg.ClientName == "" || arg.Address == "" ||
 		arg.PaymentMethod == "" || arg.Currency == "" || arg.FiatAmount.Sign() <= 0 {
@@ -80,15 +179,21 @@ func CreateOrderHandler(c *soso.Context, arg *struct {
 		PaymentMethod: arg.PaymentMethod,
 		Currency:      arg.Currency,
 		FiatAmount:    arg.FiatAmount,
+		QuoteID:       arg.QuoteID,
 	})
 
 	if err != nil {
 		err := err.(rabbit.RPCError)
-		if err.Kind != rabbit.RPCError_Forwarded {
+		switch {
+		case err.Kind != rabbit.RPCError_Forwarded:
 			c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, errors.New("service unavailable"))
-			return
+		case proto.IsLimitError(err),
+			err.Error() == proto.InvalidDestinationError,
+			err.Error() == proto.UnknownDestinationError:
+			c.ErrorResponse(http.StatusBadRequest, soso.LevelError, err)
+		default:
+			c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, err)
 		}
-		c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, err)
 		return
 	}
 
@@ -172,3 +277,97 @@ func MarkPayedHandler(c *soso.Context, arg *struct {
 
 	c.SuccessResponse("success")
 }
+
+func OpenDisputeHandler(c *soso.Context, arg *struct {
+	OrderID uint64 `json:"order_id"`
+	Address string `json:"address"`
+	Reason  string `json:"reason"`
+}) {
+	if arg.OrderID == 0 || arg.Reason == "" {
+		c.ErrorResponse(http.StatusBadRequest, soso.LevelError, errors.New("bad request"))
+		return
+	}
+
+	order, err := GetOrder(arg.OrderID)
+	if err != nil {
+		err := err.(rabbit.RPCError)
+		if err.Kind != rabbit.RPCError_Forwarded {
+			c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, errors.New("service unavailable"))
+			return
+		}
+		c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, err)
+		return
+	}
+
+	if order.Destination != arg.Address {
+		c.ErrorResponse(http.StatusForbidden, soso.LevelError, errors.New("forbidden"))
+		return
+	}
+
+	order, err = OpenDispute(proto.OpenDisputeRequest{
+		OrderID: order.ID,
+		Reason:  arg.Reason,
+	})
+	if err != nil {
+		err := err.(rabbit.RPCError)
+		if err.Kind != rabbit.RPCError_Forwarded {
+			c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, errors.New("service unavailable"))
+			return
+		}
+		c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, err)
+		return
+	}
+
+	c.SuccessResponse(order)
+}
+
+func GetRatesHandler(c *soso.Context, arg *struct {
+	// Optional, rates of every known currency will be returned if empty
+	Currency string `json:"currency"`
+}) {
+	rates, err := GetRates(arg.Currency)
+
+	if err != nil {
+		err := err.(rabbit.RPCError)
+		if err.Kind != rabbit.RPCError_Forwarded {
+			c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, errors.New("service unavailable"))
+			return
+		}
+		c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, err)
+		return
+	}
+
+	c.SuccessResponse(rates)
+}
+
+// Responds with current rates, changes are sent as rates/event afterwards
+func SubscribeRatesHandler(c *soso.Context, arg *struct {
+	// Optional, every currency if empty
+	Currencies []string `json:"currencies"`
+}) {
+	if c.Token == nil {
+		c.ErrorResponse(http.StatusBadRequest, soso.LevelError, errors.New("token is required"))
+		return
+	}
+
+	rates, err := GetRates("")
+	if err != nil {
+		err := err.(rabbit.RPCError)
+		if err.Kind != rabbit.RPCError_Forwarded {
+			c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, errors.New("service unavailable"))
+			return
+		}
+		c.ErrorResponse(http.StatusInternalServerError, soso.LevelError, err)
+		return
+	}
+
+	rateSubscriptions.Subscribe(c.Token.UID, arg.Currencies)
+
+	ret := []proto.Rate{}
+	for _, rate := range rates {
+		if rateSubscriptions.Wants(c.Token.UID, rate.Currency) {
+			ret = append(ret, rate)
+		}
+	}
+	c.SuccessResponse(ret)
+}
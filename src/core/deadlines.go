@@ -0,0 +1,159 @@
+package main
+
+import (
+	"common/db"
+	"common/log"
+	"common/rabbit"
+	"core/proto"
+	"fmt"
+	"time"
+)
+
+func init() {
+	rabbit.AddPublishers(rabbit.Publisher{
+		Name:    "order_warning",
+		Routes:  []rabbit.Route{proto.OrderWarningRoute},
+		Confirm: true,
+	})
+}
+
+// Warning which was sent to client, so it is not repeated
+type SentOrderWarning struct {
+	ID      uint64
+	OrderID uint64                 `gorm:"unique_index:idx_sent_order_warning"`
+	Kind    proto.OrderWarningKind `gorm:"unique_index:idx_sent_order_warning"`
+	// Time before deadline warning is sent at
+	BeforeDeadline time.Duration `gorm:"unique_index:idx_sent_order_warning"`
+	CreatedAt      time.Time
+}
+
+func deadlineAfter(start time.Time, timeout time.Duration) time.Time {
+	if start.IsZero() {
+		return time.Time{}
+	}
+	return start.Add(timeout)
+}
+
+// Returns deadline of current order stage and timeout of the stage, false if stage does not have one
+func (order Order) deadline() (proto.OrderWarningKind, time.Time, time.Duration, bool) {
+	t := conf.OrderTimeouts
+	switch order.Status {
+	case proto.OrderStatus_New:
+		return proto.OrderWarning_Accept, deadlineAfter(order.CreatedAt, t.Accept), t.Accept, true
+	case proto.OrderStatus_Payment:
+		return proto.OrderWarning_Payment, deadlineAfter(order.PaymentRequestedAt, t.Payment), t.Payment, true
+	case proto.OrderStatus_Confirmation:
+		return proto.OrderWarning_Confirmation, deadlineAfter(order.MarkedPayedAt, t.Confirm), t.Confirm, true
+	}
+	return 0, time.Time{}, 0, false
+}
+
+var warningActions = map[proto.OrderWarningKind]string{
+	proto.OrderWarning_Accept:       "find operator",
+	proto.OrderWarning_Payment:      "pay",
+	proto.OrderWarning_Confirmation: "confirm payment",
+}
+
+func warningMessage(kind proto.OrderWarningKind, before time.Duration) string {
+	left := fmt.Sprintf("%v seconds", int64(before/time.Second))
+	if before%time.Minute == 0 {
+		left = fmt.Sprintf("%v minutes", int64(before/time.Minute))
+	}
+	return fmt.Sprintf("%v left to %v", left, warningActions[kind])
+}
+
+// Sends warnings for orders which deadlines are closer than configured warning times.
+// Called by order manager after timeouts are processed.
+func sendDeadlineWarnings() {
+	if len(conf.OrderWarnings) == 0 {
+		return
+	}
+	var orders []Order
+	err := db.New().Find(&orders, "status IN (?)", []proto.OrderStatus{
+		proto.OrderStatus_New,
+		proto.OrderStatus_Payment,
+		proto.OrderStatus_Confirmation,
+	}).Error
+	if err != nil {
+		log.Errorf("failed to load orders for deadline warnings: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, order := range orders {
+		_, deadline, timeout, ok := order.deadline()
+		left := deadline.Sub(now)
+		if !ok || deadline.IsZero() || left <= 0 {
+			continue
+		}
+		// Only the closest passed warning is sent, longer ones are useless already
+		var before time.Duration
+		for _, b := range conf.OrderWarnings {
+			if b < timeout && left <= b && (before == 0 || b < before) {
+				before = b
+			}
+		}
+		if before == 0 {
+			continue
+		}
+		err := warnOrder(order.ID, before)
+		if err != nil {
+			log.Errorf("failed to warn about deadline of order %v: %v", order.ID, err)
+		}
+	}
+}
+
+func warnOrder(orderID uint64, before time.Duration) error {
+	tx := db.NewTransaction()
+	order, err := LockLoadOrderByID(tx, orderID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load order: %v", err)
+	}
+	kind, deadline, _, ok := order.deadline()
+	if !ok {
+		tx.Rollback()
+		return nil
+	}
+
+	var count int
+	err = tx.Model(&SentOrderWarning{}).
+		Where("order_id = ? AND kind = ? AND before_deadline <= ?", order.ID, kind, before).
+		Count(&count).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to check sent warnings: %v", err)
+	}
+	if count != 0 {
+		tx.Rollback()
+		return nil
+	}
+
+	err = tx.Create(&SentOrderWarning{
+		OrderID:        order.ID,
+		Kind:           kind,
+		BeforeDeadline: before,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save warning: %v", err)
+	}
+	seq, err := nextOrderEventSeq(tx, order.ID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to number warning: %v", err)
+	}
+	err = enqueueEvent(tx, "order_warning", proto.OrderWarning{
+		Seq:         seq,
+		OrderID:     order.ID,
+		Destination: order.Destination,
+		Kind:        kind,
+		Deadline:    deadline,
+		Message:     warningMessage(kind, before),
+	})
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to enqueue warning: %v", err)
+	}
+	return tx.Commit().Error
+}
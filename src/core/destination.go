@@ -0,0 +1,91 @@
+package main
+
+import (
+	"common/log"
+	"common/rabbit"
+	"core/proto"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Length bounds of bitshares account name
+const (
+	minAccountNameLength = 3
+	maxAccountNameLength = 63
+)
+
+// Every dot separated part of name should start with letter, end with letter or digit
+// and contain only lowercase letters, digits and dashes.
+var accountNameLabel = regexp.MustCompile(`^[a-z]([a-z0-9-]*[a-z0-9])?$`)
+
+func IsValidAccountName(name string) bool {
+	if len(name) < minAccountNameLength || len(name) > maxAccountNameLength {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !accountNameLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+type destinationCheck struct {
+	exists    bool
+	checkedAt time.Time
+}
+
+var destinationCache = struct {
+	sync.Mutex
+	checks map[string]destinationCheck
+}{checks: map[string]destinationCheck{}}
+
+// Checks that bitshares account exists, asks payer if there is no fresh result in cache.
+// If payer or bitshares is unavailable, destination is accepted: payout to unknown account fails
+// and goes to admin, which is better than rejecting every order.
+func ValidateDestination(name string) error {
+	if !IsValidAccountName(name) {
+		return errors.New(proto.InvalidDestinationError)
+	}
+
+	destinationCache.Lock()
+	check, ok := destinationCache.checks[name]
+	destinationCache.Unlock()
+	if !ok || time.Since(check.checkedAt) > conf.DestinationCacheTTL {
+		resp, err := validateDestinationRPC(name)
+		if err != nil {
+			if err, ok := err.(rabbit.RPCError); ok && err.Kind == rabbit.RPCError_Forwarded {
+				return errors.New("failed to validate destination")
+			}
+			log.Errorf("failed to validate destination %v, accepting it unchecked: %v", name, err)
+			return nil
+		}
+		if resp.Unavailable {
+			log.Errorf("failed to validate destination %v, accepting it unchecked: %v", name, resp.Message)
+			return nil
+		}
+		if !resp.Exists && resp.Message != "" {
+			log.Debug("destination %v does not exist: %v", name, resp.Message)
+		}
+		check = destinationCheck{
+			exists:    resp.Exists,
+			checkedAt: time.Now(),
+		}
+		destinationCache.Lock()
+		for cached, c := range destinationCache.checks {
+			if time.Since(c.checkedAt) > conf.DestinationCacheTTL {
+				delete(destinationCache.checks, cached)
+			}
+		}
+		destinationCache.checks[name] = check
+		destinationCache.Unlock()
+	}
+
+	if !check.exists {
+		return errors.New(proto.UnknownDestinationError)
+	}
+	return nil
+}
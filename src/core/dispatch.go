@@ -0,0 +1,185 @@
+package main
+
+import (
+	"common/db"
+	"common/log"
+	"core/proto"
+	"github.com/shopspring/decimal"
+	"math"
+	"sort"
+	"time"
+)
+
+// Decides which of suitable operators will receive offer of an order.
+// Methods are called from manager loop only, so implementations may keep state without locks.
+type dispatchStrategy interface {
+	// Returns subset of candidates which should receive offer right now.
+	// progress is part of accept timeout passed since order creation.
+	// Order will be dispatched again later with the rest of candidates if subset is incomplete.
+	Select(order Order, candidates []Operator, progress float64) []Operator
+	// Called when operator accepted offered order
+	Accepted(order Order, op Operator)
+}
+
+var dispatchStrategies = map[string]func() dispatchStrategy{
+	"broadcast":    func() dispatchStrategy { return broadcastStrategy{} },
+	"round_robin":  func() dispatchStrategy { return &roundRobinStrategy{} },
+	"least_recent": func() dispatchStrategy { return leastRecentStrategy{} },
+	"weighted":     func() dispatchStrategy { return weightedStrategy{} },
+}
+
+const DefaultDispatchStrategy = "broadcast"
+
+func newDispatchStrategy(name string) dispatchStrategy {
+	if name == "" {
+		name = DefaultDispatchStrategy
+	}
+	constructor, ok := dispatchStrategies[name]
+	if !ok {
+		log.Fatalf("unknown dispatch strategy '%v'", name)
+	}
+	return constructor()
+}
+
+// Returns part of accept timeout passed since order creation
+func dispatchProgress(order Order) float64 {
+	progress := float64(time.Since(order.CreatedAt)) / float64(conf.OrderTimeouts.Accept)
+	return math.Max(0, math.Min(1, progress))
+}
+
+// Takes from ranked candidates as much as should be offered with current progress:
+// one operator at start, everyone once FullAfter part of accept timeout is passed.
+func widenedPrefix(ranked []Operator, progress float64) []Operator {
+	if len(ranked) == 0 || progress >= conf.Dispatch.FullAfter {
+		return ranked
+	}
+	width := 1 + int(float64(len(ranked)-1)*progress/conf.Dispatch.FullAfter)
+	return ranked[:width]
+}
+
+// Offers order to everyone at once, first accept wins
+type broadcastStrategy struct{}
+
+func (broadcastStrategy) Select(order Order, candidates []Operator, progress float64) []Operator {
+	return candidates
+}
+
+func (broadcastStrategy) Accepted(Order, Operator) {}
+
+// Starts from operator next to last served one
+type roundRobinStrategy struct {
+	lastServed uint64
+}
+
+func (s *roundRobinStrategy) Select(order Order, candidates []Operator, progress float64) []Operator {
+	ranked := make([]Operator, len(candidates))
+	copy(ranked, candidates)
+	sort.Slice(ranked, func(i, j int) bool {
+		iNext, jNext := ranked[i].ID > s.lastServed, ranked[j].ID > s.lastServed
+		if iNext != jNext {
+			return iNext
+		}
+		return ranked[i].ID < ranked[j].ID
+	})
+	return widenedPrefix(ranked, progress)
+}
+
+func (s *roundRobinStrategy) Accepted(order Order, op Operator) {
+	s.lastServed = op.ID
+}
+
+// Prefers operators who did not serve orders for longest time
+type leastRecentStrategy struct{}
+
+func (leastRecentStrategy) Select(order Order, candidates []Operator, progress float64) []Operator {
+	var rows []struct {
+		OperatorID uint64
+		LastOrder  uint64
+	}
+	err := db.New().Model(&Order{}).
+		Select("operator_id, max(id) as last_order").
+		Where("operator_id in (?)", operatorIDs(candidates)).
+		Group("operator_id").
+		Scan(&rows).Error
+	if err != nil {
+		log.Errorf("failed to load last served orders: %v", err)
+		return widenedPrefix(candidates, progress)
+	}
+	last := map[uint64]uint64{}
+	for _, row := range rows {
+		last[row.OperatorID] = row.LastOrder
+	}
+
+	ranked := make([]Operator, len(candidates))
+	copy(ranked, candidates)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return last[ranked[i].ID] < last[ranked[j].ID]
+	})
+	return widenedPrefix(ranked, progress)
+}
+
+func (leastRecentStrategy) Accepted(Order, Operator) {}
+
+// Completion rate of operators without finished orders
+const neutralCompletionRate = 0.5
+
+// Ranks operators by weighted sum of relative deposit and completion rate of previous orders
+type weightedStrategy struct{}
+
+func (weightedStrategy) Select(order Order, candidates []Operator, progress float64) []Operator {
+	var rows []struct {
+		OperatorID uint64
+		Total      int64
+		Completed  int64
+	}
+	err := db.New().Model(&Order{}).
+		Select("operator_id, count(*) as total, sum(case when status in (?) then 1 else 0 end) as completed",
+			[]proto.OrderStatus{proto.OrderStatus_Transfer, proto.OrderStatus_Finished}).
+		Where("operator_id in (?)", operatorIDs(candidates)).
+		Group("operator_id").
+		Scan(&rows).Error
+	if err != nil {
+		log.Errorf("failed to load operators completion rates: %v", err)
+		return widenedPrefix(candidates, progress)
+	}
+	rates := map[uint64]float64{}
+	for _, row := range rows {
+		rates[row.OperatorID] = float64(row.Completed) / float64(row.Total)
+	}
+
+	maxDeposit := decimal.Zero
+	for _, op := range candidates {
+		if op.Deposit.Cmp(maxDeposit) > 0 {
+			maxDeposit = op.Deposit
+		}
+	}
+
+	score := func(op Operator) float64 {
+		var deposit float64
+		if maxDeposit.Sign() > 0 {
+			deposit, _ = op.Deposit.Div(maxDeposit).Float64()
+		}
+		rate, ok := rates[op.ID]
+		if !ok {
+			rate = neutralCompletionRate
+		}
+		return conf.Dispatch.DepositWeight*deposit + conf.Dispatch.CompletionWeight*rate
+	}
+
+	ranked := make([]Operator, len(candidates))
+	copy(ranked, candidates)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return score(ranked[i]) > score(ranked[j])
+	})
+	return widenedPrefix(ranked, progress)
+}
+
+func (weightedStrategy) Accepted(Order, Operator) {}
+
+func operatorIDs(ops []Operator) []uint64 {
+	ids := make([]uint64, 0, len(ops))
+	for _, op := range ops {
+		ids = append(ids, op.ID)
+	}
+	return ids
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"common/db"
+	"common/log"
+	"core/proto"
+	"errors"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"time"
+)
+
+// Dispute can be opened by client or operator once money could be moving. Disputed order is out of reach of
+// timeouts and lb contact watcher, operator stays busy with it, so his deposit is not released until admin resolves it.
+
+// Statuses from which dispute can be opened
+var disputableStatuses = []proto.OrderStatus{
+	proto.OrderStatus_Linked,
+	proto.OrderStatus_Payment,
+	proto.OrderStatus_Confirmation,
+	proto.OrderStatus_ConfirmationExtended,
+}
+
+func isDisputableStatus(status proto.OrderStatus) bool {
+	for _, s := range disputableStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Client side of request is authorized by api, operator side is checked here
+func OpenDispute(req proto.OpenDisputeRequest) (proto.Order, error) {
+	if req.Reason == "" {
+		return proto.Order{}, errors.New("reason is required")
+	}
+
+	tx := db.NewTransaction()
+	order, err := LockLoadOrderByID(tx, req.OrderID)
+	if err != nil {
+		log.Errorf("failed to load order %v: %v", req.OrderID, err)
+		tx.Rollback()
+		return proto.Order{}, errors.New(proto.DBError)
+	}
+
+	actor := ClientActor(order.Destination)
+	if req.OperatorID != 0 {
+		if order.OperatorID != req.OperatorID {
+			tx.Rollback()
+			return proto.Order{}, errors.New("order of other operator")
+		}
+		actor = OperatorActor(req.OperatorID)
+	}
+
+	if !isDisputableStatus(order.Status) {
+		log.Debug("%v tried to dispute order %v while order had status %v", actor.Kind, order.ID, order.Status)
+		tx.Rollback()
+		return proto.Order{}, errors.New("unexpected status")
+	}
+
+	order.Status = proto.OrderStatus_Disputed
+	order.DisputedAt = time.Now()
+	order.DisputedBy = actor.Kind
+	order.DisputeReason = req.Reason
+	err = order.Save(tx, actor, req.Reason)
+	if err != nil {
+		tx.Rollback()
+		return proto.Order{}, errors.New(proto.DBError)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		log.Errorf("failed to commit in OpenDispute: %v", err)
+		return proto.Order{}, errors.New(proto.DBError)
+	}
+
+	notifyDispute(order, fmt.Sprintf("was disputed by %v: %v", actor.Kind, req.Reason))
+	return order.Encode(), nil
+}
+
+// Applies admin verdict to disputed order. clientPart is used only for split verdict.
+func resolveDispute(orderID uint64, verdict proto.DisputeVerdict, clientPart decimal.Decimal, comment string, actor Actor) error {
+	if verdict == proto.DisputeVerdict_Split &&
+		(clientPart.Cmp(decimal.Zero) <= 0 || clientPart.Cmp(decimal.New(1, 0)) >= 0) {
+		return errors.New("client part should be between 0 and 1")
+	}
+
+	tx := db.NewTransaction()
+	order, err := LockLoadOrderByID(tx, orderID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load order: %v", err)
+	}
+	if order.Status != proto.OrderStatus_Disputed {
+		tx.Rollback()
+		return errors.New("order is not disputed")
+	}
+
+	order.DisputeVerdict = verdict
+	order.DisputeComment = comment
+	if verdict == proto.DisputeVerdict_Split {
+		order.DisputeClientPart = clientPart
+	}
+
+	switch verdict {
+	case proto.DisputeVerdict_PayClient, proto.DisputeVerdict_Split:
+		_, err = confirmOrder(tx, order, actor)
+		if err != nil {
+			return err
+		}
+
+	case proto.DisputeVerdict_ReturnToOperator:
+		op, err := LockLoadOperatorByID(tx, order.OperatorID)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to load operator: %v", err)
+		}
+		order.Status = proto.OrderStatus_Unconfirmed
+		err = order.Save(tx, actor, comment)
+		if err != nil {
+			tx.Rollback()
+			return errors.New(proto.DBError)
+		}
+		err = tx.Model(&op).Updates(map[string]interface{}{
+			"status":        proto.OperatorStatus_Ready,
+			"current_order": 0,
+		}).Error
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to save operator: %v", err)
+		}
+		err = tx.Commit().Error
+		if err != nil {
+			return err
+		}
+
+	default:
+		tx.Rollback()
+		return errors.New("unknown verdict")
+	}
+
+	notifyDispute(order, fmt.Sprintf("dispute is resolved: %v", verdict))
+	return nil
+}
+
+func notifyDispute(order Order, what string) {
+	err := SendTelegramNotify(conf.TelegramChanel, fmt.Sprintf(
+		"Order %v %v\noperator: %v",
+		order.ID, what, order.OperatorID,
+	), true)
+	if err != nil {
+		log.Errorf("failed to send dispute notify: %v", err)
+	}
+}
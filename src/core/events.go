@@ -0,0 +1,172 @@
+package main
+
+import (
+	"common/db"
+	"common/log"
+	"common/rabbit"
+	"core/proto"
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	tg "telegram/proto"
+	"time"
+)
+
+// Outbox of rabbit events. Rows are written in the same transaction as changes they describe
+// and published by relay after commit. Ids are assigned at insert, so rows of concurrent
+// transactions can be published out of commit order; events of order carry per-order
+// sequence number instead, which lets subscribers drop stale ones.
+type OutboxEvent struct {
+	ID        uint64
+	Exchange  string
+	Payload   string `gorm:"type:text"`
+	Published bool   `gorm:"index"`
+	CreatedAt time.Time
+}
+
+// Decoders of stored payloads, by exchange
+var eventDecoders = map[string]func([]byte) (interface{}, error){
+	"order_event": func(data []byte) (interface{}, error) {
+		var order proto.Order
+		err := json.Unmarshal(data, &order)
+		return order, err
+	},
+	"order_warning": func(data []byte) (interface{}, error) {
+		var w proto.OrderWarning
+		err := json.Unmarshal(data, &w)
+		return w, err
+	},
+	"offer_event": func(data []byte) (interface{}, error) {
+		var e tg.OfferEvent
+		err := json.Unmarshal(data, &e)
+		return e, err
+	},
+}
+
+// Counter of events of order. Row stays locked until transaction ends,
+// so numbers of one order follow commit order.
+type OrderEventSeq struct {
+	OrderID uint64 `gorm:"primary_key"`
+	Seq     uint64
+}
+
+func nextOrderEventSeq(tx *gorm.DB, orderID uint64) (uint64, error) {
+	var seq uint64
+	err := tx.Raw(`
+		INSERT INTO order_event_seqs (order_id, seq) VALUES (?, 1)
+		ON CONFLICT (order_id) DO UPDATE SET seq = order_event_seqs.seq + 1
+		RETURNING seq`, orderID,
+	).Row().Scan(&seq)
+	return seq, err
+}
+
+// Writes event to outbox
+func enqueueEvent(tx *gorm.DB, exchange string, msg interface{}) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&OutboxEvent{Exchange: exchange, Payload: string(payload)}).Error
+}
+
+func enqueueOrderEvent(tx *gorm.DB, order Order) error {
+	seq, err := nextOrderEventSeq(tx, order.ID)
+	if err != nil {
+		return err
+	}
+	e := order.Encode()
+	e.EventSeq = seq
+	return enqueueEvent(tx, "order_event", e)
+}
+
+func enqueueOfferEvent(tx *gorm.DB, chats []int64, order Order) error {
+	seq, err := nextOrderEventSeq(tx, order.ID)
+	if err != nil {
+		return err
+	}
+	return enqueueEvent(tx, "offer_event", tg.OfferEvent{
+		Seq:   seq,
+		Chats: chats,
+		Order: order.Encode(),
+	})
+}
+
+// Publishes committed events in order of sequence numbers, backs off while rabbit is unavailable
+func EventsRelayLoop() {
+	delay := conf.EventsRelay.Tick
+	var cleanedAt time.Time
+	for {
+		time.Sleep(delay)
+
+		err := relayEvents()
+		if err != nil {
+			log.Errorf("failed to relay events: %v", err)
+			delay *= 2
+			if delay > conf.EventsRelay.MaxDelay {
+				delay = conf.EventsRelay.MaxDelay
+			}
+			continue
+		}
+		delay = conf.EventsRelay.Tick
+
+		if time.Since(cleanedAt) > time.Hour {
+			err = db.New().Delete(&OutboxEvent{},
+				"published AND created_at < ?", time.Now().Add(-conf.EventsRelay.Retention),
+			).Error
+			if err != nil {
+				log.Errorf("failed to cleanup published events: %v", err)
+			}
+			cleanedAt = time.Now()
+		}
+	}
+}
+
+// Events of one batch
+const relayBatch = 100
+
+// Ids of rows which can't be published. They are logged once and left unpublished for investigation,
+// relay runs in single goroutine, so no lock is needed.
+var brokenEvents = map[uint64]bool{}
+
+func relayEvents() error {
+	var events []OutboxEvent
+	scope := db.New().Order("id").Limit(relayBatch).Where("NOT published")
+	if len(brokenEvents) != 0 {
+		broken := make([]uint64, 0, len(brokenEvents))
+		for id := range brokenEvents {
+			broken = append(broken, id)
+		}
+		scope = scope.Where("id NOT IN (?)", broken)
+	}
+	err := scope.Find(&events).Error
+	if err != nil {
+		return fmt.Errorf("failed to load events: %v", err)
+	}
+
+	for _, event := range events {
+		decode, ok := eventDecoders[event.Exchange]
+		if !ok {
+			log.Errorf("unknown exchange '%v' of event %v, leaving it unpublished", event.Exchange, event.ID)
+			brokenEvents[event.ID] = true
+			continue
+		}
+		msg, err := decode([]byte(event.Payload))
+		if err != nil {
+			log.Errorf("failed to decode event %v, leaving it unpublished: %v", event.ID, err)
+			brokenEvents[event.ID] = true
+			continue
+		}
+		err = rabbit.Publish(event.Exchange, "", msg)
+		if err != nil {
+			// Stop here to keep order of events
+			return fmt.Errorf("failed to publish event %v: %v", event.ID, err)
+		}
+
+		// Event could be published twice if this fails, subscribers are expected to drop stale ones
+		err = db.New().Model(&event).Update("published", true).Error
+		if err != nil {
+			return fmt.Errorf("failed to mark event %v published: %v", event.ID, err)
+		}
+	}
+	return nil
+}
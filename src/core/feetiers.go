@@ -0,0 +1,229 @@
+package main
+
+import (
+	"common/db"
+	"common/log"
+	"core/proto"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/shopspring/decimal"
+	"strconv"
+	"time"
+)
+
+// Operator fee depends on tier of operator. Tier is assigned by admin or automatically:
+// operator gets tier with the highest volume threshold among ones whose volume and tenure
+// conditions are satisfied. Operators without tier get default fee from config.
+
+type FeeTier struct {
+	db.Model
+	Name string `gorm:"unique_index"`
+	// Part of lb amount which operator earns
+	Fee decimal.Decimal `gorm:"type:decimal"`
+	// Completed lb volume of last 30 days(in BTC) required for tier
+	MinMonthlyVolume decimal.Decimal `gorm:"type:decimal"`
+	// Days since registration required for tier
+	MinTenureDays uint
+}
+
+const defaultFeeTierName = "default"
+
+// Period in which completed volume is counted
+const feeTierVolumePeriod = 30 * 24 * time.Hour
+
+// Statuses of orders which count in operator volume
+var completedOrderStatuses = []proto.OrderStatus{
+	proto.OrderStatus_Transfer,
+	proto.OrderStatus_Finished,
+	proto.OrderStatus_PayoutFailed,
+}
+
+func LoadFeeTiers(db *gorm.DB) ([]FeeTier, error) {
+	var tiers []FeeTier
+	err := db.Order("min_monthly_volume DESC, min_tenure_days DESC").Find(&tiers).Error
+	return tiers, err
+}
+
+// Fee tier of operator and fee part, id is zero for default fee
+func operatorFeeRate(tx *gorm.DB, op Operator) (uint64, decimal.Decimal, error) {
+	if op.FeeTierID == 0 {
+		return 0, decimal.NewFromFloat(conf.OperatorFee), nil
+	}
+	var tier FeeTier
+	err := tx.First(&tier, "id = ?", op.FeeTierID).Error
+	if err == gorm.ErrRecordNotFound {
+		log.Errorf("operator %v has missing fee tier %v", op.ID, op.FeeTierID)
+		return 0, decimal.NewFromFloat(conf.OperatorFee), nil
+	}
+	return tier.ID, tier.Fee, err
+}
+
+// Highest fee any operator can take. Accepting operator is unknown before order is linked,
+// so quotes and previews are estimated with it to not promise client more than it gets.
+func maxOperatorFeeRate(db *gorm.DB) (decimal.Decimal, error) {
+	fee := decimal.NewFromFloat(conf.OperatorFee)
+	tiers, err := LoadFeeTiers(db)
+	if err != nil {
+		return fee, err
+	}
+	for _, tier := range tiers {
+		if tier.Fee.Cmp(fee) > 0 {
+			fee = tier.Fee
+		}
+	}
+	return fee, nil
+}
+
+func operatorMonthlyVolume(db *gorm.DB, operatorID uint64) (decimal.Decimal, error) {
+	var volume decimal.Decimal
+	err := db.Model(&Order{}).
+		// Only settled part of split order counts
+		Select("COALESCE(SUM(CASE WHEN dispute_verdict = ? THEN lb_amount * dispute_client_part ELSE lb_amount END), 0)",
+			proto.DisputeVerdict_Split).
+		Where("operator_id = ? AND status IN (?) AND confirmed_at > ?",
+			operatorID, completedOrderStatuses, time.Now().Add(-feeTierVolumePeriod)).
+		Row().Scan(&volume)
+	return volume, err
+}
+
+func tenureDays(op Operator) uint {
+	return uint(time.Since(op.CreatedAt) / (24 * time.Hour))
+}
+
+// Returns best tier operator qualifies for, tiers should be sorted as LoadFeeTiers does
+func qualifiedFeeTier(tiers []FeeTier, volume decimal.Decimal, tenure uint) *FeeTier {
+	for i, tier := range tiers {
+		if volume.Cmp(tier.MinMonthlyVolume) >= 0 && tenure >= tier.MinTenureDays {
+			return &tiers[i]
+		}
+	}
+	return nil
+}
+
+// Returns tier following the current one, tiers should be sorted as LoadFeeTiers does
+func nextFeeTier(tiers []FeeTier, current *FeeTier) *FeeTier {
+	var next *FeeTier
+	for i, tier := range tiers {
+		if current != nil && tier.MinMonthlyVolume.Cmp(current.MinMonthlyVolume) <= 0 {
+			continue
+		}
+		next = &tiers[i]
+	}
+	return next
+}
+
+// Reassigns tier of every operator whose tier is not fixed by admin
+func FeeTiersLoop() {
+	for {
+		var ids []uint64
+		err := db.New().Model(&Operator{}).Where("NOT fee_tier_manual").Pluck("id", &ids).Error
+		if err != nil {
+			log.Errorf("failed to load operators for fee tiers update: %v", err)
+		}
+		for _, id := range ids {
+			err := updateFeeTier(id)
+			if err != nil {
+				log.Errorf("failed to update fee tier of operator %v: %v", id, err)
+			}
+		}
+		time.Sleep(conf.FeeTiersTick)
+	}
+}
+
+func updateFeeTier(operatorID uint64) error {
+	tiers, err := LoadFeeTiers(db.New())
+	if err != nil {
+		return fmt.Errorf("failed to load fee tiers: %v", err)
+	}
+	volume, err := operatorMonthlyVolume(db.New(), operatorID)
+	if err != nil {
+		return fmt.Errorf("failed to count volume: %v", err)
+	}
+
+	tx := db.NewTransaction()
+	op, err := LockLoadOperatorByID(tx, operatorID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load operator: %v", err)
+	}
+	tier := qualifiedFeeTier(tiers, volume, tenureDays(op))
+	var tierID uint64
+	if tier != nil {
+		tierID = tier.ID
+	}
+	if op.FeeTierManual || op.FeeTierID == tierID {
+		tx.Rollback()
+		return nil
+	}
+	err = tx.Model(&op).Update("fee_tier_id", tierID).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save operator: %v", err)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+
+	name, fee := defaultFeeTierName, decimal.NewFromFloat(conf.OperatorFee)
+	if tier != nil {
+		name, fee = tier.Name, tier.Fee
+	}
+	log.Info("fee tier of operator %v was changed to '%v'", operatorID, name)
+	err = SendTelegramNotify(strconv.FormatInt(op.TelegramChat, 10), fmt.Sprintf(
+		M("your fee tier is changed to %v, your fee is %v%% now"), name, fee.Mul(decimal.New(100, 0)),
+	), false)
+	if err != nil {
+		log.Errorf("failed to send fee tier notify: %v", err)
+	}
+	return nil
+}
+
+func GetFeeTierStatus(operatorID uint64) (proto.FeeTierStatus, error) {
+	var op Operator
+	scope := db.New().First(&op, "id = ?", operatorID)
+	switch {
+	case scope.RecordNotFound():
+		return proto.FeeTierStatus{}, errors.New("operator not found")
+
+	case scope.Error != nil:
+		log.Errorf("failed to load operator %v: %v", operatorID, scope.Error)
+		return proto.FeeTierStatus{}, errors.New(proto.DBError)
+	}
+	tiers, err := LoadFeeTiers(db.New())
+	if err != nil {
+		log.Errorf("failed to load fee tiers: %v", err)
+		return proto.FeeTierStatus{}, errors.New(proto.DBError)
+	}
+	volume, err := operatorMonthlyVolume(db.New(), operatorID)
+	if err != nil {
+		log.Errorf("failed to count volume of operator %v: %v", operatorID, err)
+		return proto.FeeTierStatus{}, errors.New(proto.DBError)
+	}
+
+	ret := proto.FeeTierStatus{
+		Tier:          defaultFeeTierName,
+		Fee:           decimal.NewFromFloat(conf.OperatorFee),
+		Manual:        op.FeeTierManual,
+		MonthlyVolume: volume,
+	}
+	var current *FeeTier
+	for i, tier := range tiers {
+		if tier.ID == op.FeeTierID {
+			current = &tiers[i]
+			ret.Tier = tier.Name
+			ret.Fee = tier.Fee
+		}
+	}
+	if !op.FeeTierManual {
+		next := nextFeeTier(tiers, current)
+		if next != nil {
+			ret.NextTier = next.Name
+			ret.NextFee = next.Fee
+			ret.NextVolume = next.MinMonthlyVolume
+			ret.NextTenureDays = next.MinTenureDays
+		}
+	}
+	return ret, nil
+}
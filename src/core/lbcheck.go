@@ -5,7 +5,6 @@ import (
 	"common/log"
 	"core/proto"
 	"fmt"
-	"github.com/jinzhu/gorm"
 	"lbapi"
 	"strconv"
 	"strings"
@@ -56,7 +55,7 @@ func ProcessIncomingTx(event lbapi.Transaction) error {
 	operatorStr := strings.TrimPrefix(event.Description, proto.DepositTransactionPrefix)
 	operatorID, err := strconv.ParseUint(operatorStr, 36, 64)
 	if err != nil {
-		log.Warn("invalid account id '%v' it transaction %v", operatorStr, data.ID)
+		log.Warn(fmt.Sprintf("invalid account id '%v' it transaction %v", operatorStr, data.ID))
 		// transaction itself should be saved in any case
 		return tx.Commit().Error
 	}
@@ -66,14 +65,19 @@ func ProcessIncomingTx(event lbapi.Transaction) error {
 	res := tx.First(&op, "id = ?", operatorID)
 	switch {
 	case res.RecordNotFound():
-		log.Warn("found deposit transaction %v with unknown operator id", data.ID)
+		log.Warn(fmt.Sprintf("found deposit transaction %v with unknown operator id", data.ID))
 		return tx.Commit().Error
 	case res.Error != nil:
 		tx.Rollback()
 		return res.Error
 	}
 
-	err = tx.Model(&op).Update("deposit", gorm.Expr("deposit + ?", event.Amount)).Error
+	_, err = op.ChangeDeposit(tx, DepositEntry{
+		Type:            proto.DepositEntryType_Refill,
+		Amount:          event.Amount,
+		LBTransactionID: data.ID,
+		Comment:         event.Description,
+	})
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"common/db"
+	"common/log"
+	"core/proto"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// Orders in this statuses have linked lb contact which should be watched
+var watchedStatuses = []proto.OrderStatus{
+	proto.OrderStatus_Linked,
+	proto.OrderStatus_Payment,
+	proto.OrderStatus_Confirmation,
+	proto.OrderStatus_ConfirmationExtended,
+}
+
+func LBContactsLoop() {
+	for range time.Tick(conf.LBContactsTick) {
+		var orders []Order
+		err := db.New().Find(&orders, "status in (?) AND lb_contact_id != 0", watchedStatuses).Error
+		if err != nil {
+			log.Errorf("failed to load list of linked orders: %v", err)
+			continue
+		}
+
+		for _, order := range orders {
+			err := checkLBContact(order)
+			if err != nil {
+				log.Errorf("failed to check lb contact %v of order %v: %v", order.LBContactID, order.ID, err)
+			}
+		}
+	}
+}
+
+func checkLBContact(order Order) error {
+	var op Operator
+	err := db.New().First(&op, "id = ?", order.OperatorID).Error
+	if err != nil {
+		return fmt.Errorf("failed to load operator %v: %v", order.OperatorID, err)
+	}
+
+	contact, err := op.Key.ContactInfo(order.LBContactID)
+	if err != nil {
+		return err
+	}
+
+	data := contact.Data
+	switch {
+	case !data.ReleasedAt.IsZero():
+		return onContactReleased(order.ID, order.LBContactID)
+	case !data.DisputedAt.IsZero():
+		return onContactDisputed(order.ID, order.LBContactID, data.DisputedAt)
+	// Contact is closed but was not released, so it was canceled
+	case !data.ClosedAt.IsZero():
+		return onContactCanceled(order.ID, order.LBContactID)
+	case !data.PaymentCompletedAt.IsZero():
+		return onContactPayed(order.ID, order.LBContactID)
+	}
+	return nil
+}
+
+// Loads order and checks that it is still linked to the same contact and have one of watched statuses.
+// Returns false if there is nothing to do with order anymore
+func lockLoadWatchedOrder(tx *gorm.DB, orderID, contactID uint64) (Order, bool, error) {
+	order, err := LockLoadOrderByID(tx, orderID)
+	if err != nil {
+		return order, false, fmt.Errorf("failed to load order: %v", err)
+	}
+	if order.LBContactID != contactID {
+		return order, false, nil
+	}
+	for _, status := range watchedStatuses {
+		if order.Status == status {
+			return order, true, nil
+		}
+	}
+	return order, false, nil
+}
+
+func onContactPayed(orderID, contactID uint64) error {
+	tx := db.NewTransaction()
+	order, ok, err := lockLoadWatchedOrder(tx, orderID, contactID)
+	if err != nil || !ok {
+		tx.Rollback()
+		return err
+	}
+	if order.Status != proto.OrderStatus_Linked && order.Status != proto.OrderStatus_Payment {
+		tx.Rollback()
+		return nil
+	}
+
+	order.Status = proto.OrderStatus_Confirmation
+	order.MarkedPayedAt = time.Now()
+	err = order.Save(tx, LBActor, fmt.Sprintf("lb contact %v was marked as paid", contactID))
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save order: %v", err)
+	}
+	return tx.Commit().Error
+}
+
+func onContactReleased(orderID, contactID uint64) error {
+	tx := db.NewTransaction()
+	order, ok, err := lockLoadWatchedOrder(tx, orderID, contactID)
+	if err != nil || !ok {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = confirmOrder(tx, order, LBActor)
+	return err
+}
+
+func onContactCanceled(orderID, contactID uint64) error {
+	tx := db.NewTransaction()
+	order, ok, err := lockLoadWatchedOrder(tx, orderID, contactID)
+	if err != nil || !ok {
+		tx.Rollback()
+		return err
+	}
+
+	op, err := LockLoadOperatorByID(tx, order.OperatorID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load operator %v: %v", order.OperatorID, err)
+	}
+	err = tx.Model(&op).Updates(map[string]interface{}{
+		"status":        proto.OperatorStatus_Ready,
+		"current_order": 0,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to withdraw order from operator: %v", err)
+	}
+
+	order.Status = proto.OrderStatus_Canceled
+	order.CanceledBy = LBActor.Kind
+	err = order.Save(tx, LBActor, fmt.Sprintf("lb contact %v was canceled", contactID))
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save order: %v", err)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+
+	notifyContactChange(order, "was canceled")
+	return nil
+}
+
+func onContactDisputed(orderID, contactID uint64, disputedAt time.Time) error {
+	tx := db.NewTransaction()
+	order, ok, err := lockLoadWatchedOrder(tx, orderID, contactID)
+	if err != nil || !ok {
+		tx.Rollback()
+		return err
+	}
+	// Already flagged
+	if !order.LBDisputedAt.IsZero() {
+		tx.Rollback()
+		return nil
+	}
+
+	// Dispute on lb is resolved by admin as well
+	order.LBDisputedAt = disputedAt
+	order.Status = proto.OrderStatus_Disputed
+	order.DisputedAt = disputedAt
+	order.DisputedBy = LBActor.Kind
+	order.DisputeReason = "lb contact was disputed"
+	err = order.Save(tx, LBActor, order.DisputeReason)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save order: %v", err)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+
+	notifyContactChange(order, "was disputed")
+	return nil
+}
+
+func notifyContactChange(order Order, what string) {
+	err := SendTelegramNotify(conf.TelegramChanel, fmt.Sprintf(
+		"LB contact %v of order %v %v\noperator: %v",
+		order.LBContactID, order.ID, what, order.OperatorID,
+	), true)
+	if err != nil {
+		log.Errorf("failed to send lb contact notify: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"common/log"
+	"core/proto"
+	"errors"
+	"github.com/jinzhu/gorm"
+	"github.com/shopspring/decimal"
+	"lbapi"
+)
+
+// Contacts of operator are matched to order by currency and fiat amount within tolerance.
+// Matched ones are scored: exact amount, creation after order and lb buffer as seller add points.
+// Contacts linked to other orders are skipped. Only contacts with the best score are returned,
+// so several of them mean operator should choose.
+
+// Score of contact or -1 if it does not match order at all
+func scoreContact(order Order, contact lbapi.Contact) int {
+	if contact.Data.Currency != order.Currency {
+		return -1
+	}
+	diff := contact.Data.Amount.Sub(order.FiatAmount).Abs()
+	if diff.Cmp(order.FiatAmount.Mul(decimal.NewFromFloat(conf.ContactAmountTolerance))) > 0 {
+		return -1
+	}
+
+	score := 1
+	if diff.Sign() == 0 {
+		score++
+	}
+	// Contacts created before order most likely belong to other deals
+	if contact.Data.CreatedAt.After(order.CreatedAt) {
+		score++
+	}
+	if contact.Data.Seller.Username == LBSelf.Username {
+		score++
+	}
+	return score
+}
+
+// Returns set of passed contacts which are linked to orders other than passed one
+func linkedContacts(tx *gorm.DB, order Order, ids []uint64) (map[uint64]bool, error) {
+	var linked []uint64
+	err := tx.Model(&Order{}).
+		Where("lb_contact_id IN (?) AND id != ? AND status NOT IN (?)", ids, order.ID, failedOrderStatuses).
+		Pluck("lb_contact_id", &linked).Error
+	if err != nil {
+		return nil, err
+	}
+	ret := map[uint64]bool{}
+	for _, id := range linked {
+		ret[id] = true
+	}
+	return ret, nil
+}
+
+// Returns best matching contacts of order, which are not linked to other orders
+func matchLBContacts(tx *gorm.DB, order Order, contacts []lbapi.Contact) ([]lbapi.Contact, error) {
+	if len(contacts) == 0 {
+		return nil, nil
+	}
+	isLinked, err := linkedContacts(tx, order, contactIDs(contacts))
+	if err != nil {
+		return nil, err
+	}
+
+	var best []lbapi.Contact
+	bestScore := 0
+	for _, contact := range contacts {
+		if isLinked[contact.Data.ContactID] {
+			continue
+		}
+		score := scoreContact(order, contact)
+		switch {
+		case score < 0 || score < bestScore:
+		case score > bestScore:
+			best = []lbapi.Contact{contact}
+			bestScore = score
+		default:
+			best = append(best, contact)
+		}
+	}
+	return best, nil
+}
+
+func contactIDs(contacts []lbapi.Contact) []uint64 {
+	ret := make([]uint64, 0, len(contacts))
+	for _, contact := range contacts {
+		ret = append(ret, contact.Data.ContactID)
+	}
+	return ret
+}
+
+// Loads contact passed by operator explicitly and checks that it is open contact of operator
+// which matches order and is not linked to other order. Returns one of proto errors.
+func loadExplicitContact(tx *gorm.DB, order Order, op Operator, contactID uint64) (lbapi.Contact, error) {
+	contact, err := op.Key.ContactInfo(contactID)
+	if err != nil {
+		log.Debug("failed to load lb contact %v of operator %v: %v", contactID, op.ID, err)
+		return contact, errors.New(proto.ContactNotFoundError)
+	}
+	if contact.Data.Buyer.Username != op.Username && contact.Data.Seller.Username != op.Username {
+		return contact, errors.New(proto.ContactMismatchError)
+	}
+	if !contact.Data.ClosedAt.IsZero() || scoreContact(order, contact) < 0 {
+		return contact, errors.New(proto.ContactMismatchError)
+	}
+	linked, err := linkedContacts(tx, order, []uint64{contactID})
+	if err != nil {
+		log.Errorf("failed to check links of lb contact %v: %v", contactID, err)
+		return contact, errors.New(proto.DBError)
+	}
+	if linked[contactID] {
+		return contact, errors.New(proto.ContactMismatchError)
+	}
+	return contact, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"common/db"
+	"common/log"
+	"common/rabbit"
+	"database/sql"
+	"sync/atomic"
+	"time"
+)
+
+// Several core replicas can be run, every one serves rpc, but only leader runs order manager
+// and background loops. Leader is elected with postgres advisory lock, which is held by long
+// transaction, so it is released by postgres as soon as leader connection is gone.
+// Leader which lost its connection exits, since its loops can not be stopped, and followers take over
+// on their next check. So two leaders could coexist for at most one leader tick.
+
+// Key of advisory lock held by leader
+const leaderLockKey = 0x636f7265
+
+// 1 while current replica is leader
+var leading int32
+
+func IsLeader() bool {
+	return atomic.LoadInt32(&leading) == 1
+}
+
+// Blocks until leadership is lost, calls elected once lock is acquired
+func RunLeaderElection(elected func()) {
+	for {
+		lock, err := tryLeaderLock()
+		if err != nil {
+			log.Errorf("failed to try leader lock: %v", err)
+		}
+		if lock != nil {
+			log.Info("became leader")
+			// Flag is set before loops are started, so pushes made during takeover are not dropped,
+			// they wait on manager channels until manager loop is running
+			atomic.StoreInt32(&leading, 1)
+			elected()
+			holdLeaderLock(lock)
+			log.Fatalf("leader lock is lost")
+		}
+		time.Sleep(conf.Leader.Tick)
+	}
+}
+
+// Returns transaction holding lock or nil if lock is held by other replica
+func tryLeaderLock() (*sql.Tx, error) {
+	tx, err := db.New().DB().Begin()
+	if err != nil {
+		return nil, err
+	}
+	var acquired bool
+	err = tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", leaderLockKey).Scan(&acquired)
+	if err != nil || !acquired {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+func holdLeaderLock(lock *sql.Tx) {
+	for range time.Tick(conf.Leader.Tick) {
+		var one int
+		err := lock.QueryRow("SELECT 1").Scan(&one)
+		if err != nil {
+			log.Errorf("leader lock connection failed: %v", err)
+			lock.Rollback()
+			return
+		}
+	}
+}
+
+// Pushes to order manager made by followers are forwarded to leader through this exchange
+var managerPushRoute = rabbit.Route{
+	{
+		Node: rabbit.Exchange{
+			Name:    "core_manager_push",
+			Kind:    "fanout",
+			Durable: true,
+		},
+	},
+	{
+		Keys: []string{""},
+		Node: rabbit.Queue{
+			Name:       "",
+			Exclusive:  true,
+			AutoDelete: true,
+		},
+	},
+}
+
+type managerPushKind int
+
+const (
+	managerPush_Order    managerPushKind = 1
+	managerPush_Operator managerPushKind = 2
+	// Order was accepted by follower
+	managerPush_Accepted managerPushKind = 3
+)
+
+type managerPush struct {
+	Kind       managerPushKind
+	OrderID    uint64
+	OperatorID uint64
+	Anew       bool
+}
+
+func init() {
+	rabbit.AddPublishers(rabbit.Publisher{
+		Name:   "core_manager_push",
+		Routes: []rabbit.Route{managerPushRoute},
+	})
+	rabbit.Subscribe(rabbit.Subscription{
+		Name:           "core_manager_push",
+		Routes:         []rabbit.Route{managerPushRoute},
+		AutoAck:        true,
+		Prefetch:       10,
+		DecodedHandler: managerPushHandler,
+	})
+}
+
+func forwardToLeader(push managerPush) {
+	err := rabbit.Publish("core_manager_push", "", push)
+	if err != nil {
+		log.Errorf("failed to forward %+v to leader: %v", push, err)
+	}
+}
+
+func managerPushHandler(push managerPush) bool {
+	if !IsLeader() {
+		return true
+	}
+	switch push.Kind {
+	case managerPush_Order:
+		manager.PushOrder(push.OrderID)
+	case managerPush_Operator:
+		manager.PushOperator(push.OperatorID, push.Anew)
+	case managerPush_Accepted:
+		manager.accepted <- accept{
+			orderID:    push.OrderID,
+			operatorID: push.OperatorID,
+		}
+	default:
+		log.Errorf("unknown manager push %+v", push)
+	}
+	return true
+}
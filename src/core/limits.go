@@ -0,0 +1,144 @@
+package main
+
+import (
+	"common/db"
+	"common/log"
+	"core/proto"
+	"errors"
+	"github.com/jinzhu/gorm"
+	"github.com/shopspring/decimal"
+	"time"
+)
+
+// Rule of order limits. Rule for exact payment method takes precedence over currency-wide one.
+// If there are rules with payment methods for currency, only these methods are allowed.
+type OrderLimit struct {
+	db.Model
+	Currency string `gorm:"unique_index:idx_currency_method"`
+	// Empty for rule which applies to every method of currency
+	PaymentMethod string          `gorm:"unique_index:idx_currency_method"`
+	MinAmount     decimal.Decimal `gorm:"type:decimal"`
+	MaxAmount     decimal.Decimal `gorm:"type:decimal"`
+	// Fiat volume per client address
+	DailyLimit  decimal.Decimal `gorm:"type:decimal"`
+	WeeklyLimit decimal.Decimal `gorm:"type:decimal"`
+}
+
+func (limit OrderLimit) Encode() proto.OrderLimit {
+	return proto.OrderLimit{
+		Currency:      limit.Currency,
+		PaymentMethod: limit.PaymentMethod,
+		MinAmount:     limit.MinAmount,
+		MaxAmount:     limit.MaxAmount,
+		DailyLimit:    limit.DailyLimit,
+		WeeklyLimit:   limit.WeeklyLimit,
+	}
+}
+
+// Orders in this statuses do not count in client volume
+var failedOrderStatuses = []proto.OrderStatus{
+	proto.OrderStatus_Unrealizable,
+	proto.OrderStatus_Rejected,
+	proto.OrderStatus_Dropped,
+	proto.OrderStatus_Canceled,
+	proto.OrderStatus_Timeout,
+	proto.OrderStatus_Unconfirmed,
+}
+
+// First key of advisory locks which serialize volume checks of one destination
+const destinationLockSpace = 7001
+
+// Checks order against configured limits, returns one of proto limit errors on violation.
+// Volume is checked under advisory lock of destination held until tx ends, so tx should save the order.
+func CheckOrderLimits(tx *gorm.DB, order Order) error {
+	var rules []OrderLimit
+	err := tx.Find(&rules, "currency = ?", order.Currency).Error
+	if err != nil {
+		log.Errorf("failed to load order limits for %v: %v", order.Currency, err)
+		return errors.New(proto.DBError)
+	}
+
+	var rule *OrderLimit
+	methodRestricted := false
+	for i := range rules {
+		switch rules[i].PaymentMethod {
+		case "":
+			if rule == nil {
+				rule = &rules[i]
+			}
+		case order.PaymentMethod:
+			rule = &rules[i]
+			methodRestricted = true
+		default:
+			methodRestricted = true
+		}
+	}
+	if methodRestricted && (rule == nil || rule.PaymentMethod != order.PaymentMethod) {
+		return errors.New(proto.MethodNotAllowedError)
+	}
+	if rule == nil {
+		return nil
+	}
+
+	if rule.MinAmount.Sign() > 0 && order.FiatAmount.Cmp(rule.MinAmount) < 0 {
+		return errors.New(proto.AmountBelowMinimumError)
+	}
+	if rule.MaxAmount.Sign() > 0 && order.FiatAmount.Cmp(rule.MaxAmount) > 0 {
+		return errors.New(proto.AmountAboveMaximumError)
+	}
+
+	if rule.DailyLimit.Sign() > 0 || rule.WeeklyLimit.Sign() > 0 {
+		err := tx.Exec("SELECT pg_advisory_xact_lock(?, hashtext(?))", destinationLockSpace, order.Destination).Error
+		if err != nil {
+			log.Errorf("failed to lock destination %v: %v", order.Destination, err)
+			return errors.New(proto.DBError)
+		}
+	}
+
+	checkVolume := func(limit decimal.Decimal, period time.Duration, limitErr string) error {
+		if limit.Sign() <= 0 {
+			return nil
+		}
+		scope := tx.Model(&Order{}).Where(
+			"destination = ? AND currency = ? AND created_at > ? AND status NOT IN (?)",
+			order.Destination, order.Currency, time.Now().Add(-period), failedOrderStatuses,
+		)
+		if rule.PaymentMethod != "" {
+			scope = scope.Where("payment_method = ?", rule.PaymentMethod)
+		}
+		var volume decimal.Decimal
+		err := scope.Select("coalesce(sum(fiat_amount), 0)").Row().Scan(&volume)
+		if err != nil {
+			log.Errorf("failed to load volume of %v: %v", order.Destination, err)
+			return errors.New(proto.DBError)
+		}
+		if volume.Add(order.FiatAmount).Cmp(limit) > 0 {
+			return errors.New(limitErr)
+		}
+		return nil
+	}
+
+	err = checkVolume(rule.DailyLimit, 24*time.Hour, proto.DailyLimitExceededError)
+	if err != nil {
+		return err
+	}
+	return checkVolume(rule.WeeklyLimit, 7*24*time.Hour, proto.WeeklyLimitExceededError)
+}
+
+func GetOrderLimits(currency string) ([]proto.OrderLimit, error) {
+	var rules []OrderLimit
+	scope := db.New().Order("currency, payment_method")
+	if currency != "" {
+		scope = scope.Where("currency = ?", currency)
+	}
+	err := scope.Find(&rules).Error
+	if err != nil {
+		log.Errorf("failed to load order limits: %v", err)
+		return nil, errors.New(proto.DBError)
+	}
+	ret := make([]proto.OrderLimit, 0, len(rules))
+	for _, rule := range rules {
+		ret = append(ret, rule.Encode())
+	}
+	return ret, nil
+}
@@ -7,8 +7,12 @@ import (
 	"common/log"
 	"common/proxy"
 	"common/rabbit"
+	"flag"
+	"fmt"
+	"github.com/shopspring/decimal"
 	"lbapi"
 	"net/http"
+	"os"
 	"time"
 )
 
@@ -26,14 +30,65 @@ var conf struct {
 	// Others will be added on demand(when first order occurs)
 	PrefetchRates    []string
 	RatesRefreshTick string
+	// Rates older than this are not used for pricing
+	RatesMaxAge time.Duration
+	// Rate is published as rate_event if minimal or median one changes more than this part
+	RateEventThreshold float64
+	// Refresh interval of currencies which are requested, but not prefetched
+	RatesOnDemandTick time.Duration
+	RatesRetry        struct {
+		// Delay after first failed fetch, doubled after every next one
+		BaseDelay time.Duration
+		MaxDelay  time.Duration
+	}
+	RatesHistory struct {
+		// Interval between cleanups of rate history
+		Tick time.Duration
+		// Snapshots older than this are deleted
+		Retention time.Duration
+		// Snapshots older than this are thinned to one per interval
+		DownsampleAfter    time.Duration
+		DownsampleInterval time.Duration
+	}
+	RateProviders struct {
+		// Names of providers tried in order for currencies not listed below
+		Default    []string
+		Currencies map[string][]string
+		// Filters of lb provider
+		LB RateAdsFilter
+		// Rates of static provider
+		Static map[string]StaticRate
+		// Json file of file provider, the provider is disabled if it is empty
+		File string
+		// Derived provider is disabled if liquid currency is empty
+		Derived struct {
+			// Currency which offers give USD price of bitcoin
+			Liquid string
+			// Fiat per USD, currencies without it use ratio observed across their offers
+			CrossRates map[string]decimal.Decimal
+		}
+	}
 
 	Messages map[string]string
 
 	LBCheckTick      time.Duration
 	OrdersUpdateTick time.Duration
+	// Interval between checks of lb contacts related to active orders
+	LBContactsTick time.Duration
+	// Interval between reconciliations of operators and orders, first one is done on start
+	ReconcileTick time.Duration
+	// Interval between automatic reassignments of operator fee tiers
+	FeeTiersTick time.Duration
 
 	OperatorFee float64
 	BotFee      float64
+	// Expected lb fee as part of contact amount, used for quotes only
+	LBFeeEstimate float64
+	QuoteTTL      time.Duration
+	// How long results of bitshares account checks are cached
+	DestinationCacheTTL time.Duration
+	// Allowed difference between fiat amounts of order and lb contact, as part of order amount
+	ContactAmountTolerance float64
 
 	DB     db.Settings
 	Rabbit rabbit.Config
@@ -47,6 +102,42 @@ var conf struct {
 		Payment time.Duration
 		Confirm time.Duration
 	}
+	// Time before order deadlines when client is warned, every one is sent once per stage
+	OrderWarnings []time.Duration
+
+	PayoutRetry struct {
+		// Interval between checks of payout outbox
+		Tick time.Duration
+		// Delay after first failed transfer, doubled after every next one
+		BaseDelay time.Duration
+		MaxDelay  time.Duration
+		// Order goes to payout failed status after this number of failed transfers
+		MaxAttempts uint
+	}
+
+	EventsRelay struct {
+		// Interval between checks of events outbox
+		Tick time.Duration
+		// Longest delay between attempts while rabbit is unavailable
+		MaxDelay time.Duration
+		// How long published events are kept
+		Retention time.Duration
+	}
+
+	Leader struct {
+		// Interval between attempts to become leader and between checks of leader lock
+		Tick time.Duration
+	}
+
+	Dispatch struct {
+		// One of broadcast(default), round_robin, least_recent, weighted
+		Strategy string
+		// Part of accept timeout after which order is offered to every suitable operator
+		FullAfter float64
+		// Weights for weighted strategy
+		DepositWeight    float64
+		CompletionWeight float64
+	}
 }
 
 var (
@@ -60,6 +151,14 @@ var (
 type service struct{}
 
 func main() {
+	// common cli knows only migrate and start, so core specific commands are handled here
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "only report found issues")
+		flags.Parse(os.Args[2:])
+		Reconcile(*dryRun)
+		return
+	}
 	cli.Main(&service{})
 }
 
@@ -74,10 +173,87 @@ func (srv service) Load() {
 	if conf.OrdersUpdateTick == 0 {
 		conf.OrdersUpdateTick = 5 * time.Second
 	}
+	if conf.LBContactsTick == 0 {
+		conf.LBContactsTick = 30 * time.Second
+	}
+	if conf.ReconcileTick == 0 {
+		conf.ReconcileTick = 10 * time.Minute
+	}
+	if conf.FeeTiersTick == 0 {
+		conf.FeeTiersTick = time.Hour
+	}
+	if conf.QuoteTTL == 0 {
+		conf.QuoteTTL = 5 * time.Minute
+	}
+	if conf.DestinationCacheTTL == 0 {
+		conf.DestinationCacheTTL = 10 * time.Minute
+	}
+	if conf.ContactAmountTolerance <= 0 {
+		conf.ContactAmountTolerance = 0.01
+	}
 	t := conf.OrderTimeouts
 	if t.Accept < time.Minute || t.Payment < time.Minute || t.Confirm < time.Minute {
 		log.Fatalf("invalid order timeouts")
 	}
+	if conf.RatesMaxAge == 0 {
+		conf.RatesMaxAge = 3 * ratesRefreshTick()
+	}
+	if conf.RatesOnDemandTick == 0 {
+		conf.RatesOnDemandTick = ratesRefreshTick()
+	}
+	if conf.RatesRetry.BaseDelay == 0 {
+		conf.RatesRetry.BaseDelay = 10 * time.Second
+	}
+	if conf.RatesRetry.MaxDelay == 0 {
+		conf.RatesRetry.MaxDelay = 5 * time.Minute
+	}
+	if conf.RatesHistory.Tick == 0 {
+		conf.RatesHistory.Tick = time.Hour
+	}
+	if conf.RatesHistory.Retention == 0 {
+		conf.RatesHistory.Retention = 90 * 24 * time.Hour
+	}
+	if conf.RatesHistory.DownsampleAfter == 0 {
+		conf.RatesHistory.DownsampleAfter = 24 * time.Hour
+	}
+	if conf.RatesHistory.DownsampleInterval < time.Second {
+		conf.RatesHistory.DownsampleInterval = time.Hour
+	}
+	if conf.RatesMaxAge < ratesRefreshTick() {
+		log.Fatalf("ratesMaxAge is less than ratesRefreshTick")
+	}
+	if conf.PayoutRetry.Tick == 0 {
+		conf.PayoutRetry.Tick = 30 * time.Second
+	}
+	if conf.PayoutRetry.BaseDelay == 0 {
+		conf.PayoutRetry.BaseDelay = time.Minute
+	}
+	if conf.PayoutRetry.MaxDelay == 0 {
+		conf.PayoutRetry.MaxDelay = time.Hour
+	}
+	if conf.PayoutRetry.MaxAttempts == 0 {
+		conf.PayoutRetry.MaxAttempts = 5
+	}
+	if conf.EventsRelay.Tick == 0 {
+		conf.EventsRelay.Tick = 500 * time.Millisecond
+	}
+	if conf.EventsRelay.MaxDelay == 0 {
+		conf.EventsRelay.MaxDelay = 30 * time.Second
+	}
+	if conf.EventsRelay.Retention == 0 {
+		conf.EventsRelay.Retention = 24 * time.Hour
+	}
+	if conf.Leader.Tick == 0 {
+		conf.Leader.Tick = 5 * time.Second
+	}
+	if conf.Dispatch.FullAfter <= 0 || conf.Dispatch.FullAfter > 1 {
+		conf.Dispatch.FullAfter = 0.5
+	}
+	if conf.Dispatch.DepositWeight == 0 && conf.Dispatch.CompletionWeight == 0 {
+		conf.Dispatch.DepositWeight = 1
+		conf.Dispatch.CompletionWeight = 1
+	}
+	initRateProviders()
 
 	db.Init(&conf.DB)
 }
@@ -89,6 +265,16 @@ func (srv service) Migrate(drop bool) {
 
 func (srv service) Cleanup() {}
 
+func Reconcile(dryRun bool) {
+	srv := service{}
+	srv.Load()
+	report, err := reconcile(dryRun)
+	fmt.Print(report)
+	if err != nil {
+		log.Fatalf("failed to reconcile: %v", err)
+	}
+}
+
 func (srv service) Start() {
 	srv.Load()
 
@@ -116,22 +302,48 @@ func (srv service) Start() {
 	if err != nil {
 		log.Fatalf("failed to load currency list: %v", err)
 	}
+	methods, err := conf.LBKey.PaymentMethods()
+	if err != nil {
+		log.Fatalf("failed to load payment methods list: %v", err)
+	}
+	SetPaymentMethods(methods)
 
 	QorInit()
 
-	go RatesRefresh(conf.PrefetchRates)
-
 	rabbit.Start(&conf.Rabbit)
+	go RunLeaderElection(startLeaderLoops)
+}
+
+// Background work which must be done by single replica
+func startLeaderLoops() {
+	go RatesRefresh(conf.PrefetchRates)
+	go EventsRelayLoop()
 
 	go LBTransactionsLoop()
+	go LBContactsLoop()
+	go PayoutDispatcherLoop()
+	go FeeTiersLoop()
+	go RatesHistoryLoop()
+	// Manager should start with consistent operators
+	runReconcile()
+	go ReconcileLoop()
 	StartOrderManager()
 }
 
+func IsKnownCurrency(currency string) bool {
+	for _, cur := range CurrencyList {
+		if cur == currency {
+			return true
+		}
+	}
+	return false
+}
+
 func M(key string) string {
 	msg, ok := conf.Messages[key]
 	if ok {
 		return msg
 	}
-	log.Warn("message for key '%v' is undefined", key)
+	log.Warn(fmt.Sprintf("message for key '%v' is undefined", key))
 	return key
 }
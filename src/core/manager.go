@@ -6,6 +6,7 @@ import (
 	"common/rabbit"
 	"core/proto"
 	"fmt"
+	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
 	"strconv"
@@ -25,6 +26,9 @@ type orderManager struct {
 	orders    chan orderPush
 	operators chan opPush
 	accepts   chan accept
+	// Orders accepted on followers
+	accepted chan accept
+	strategy dispatchStrategy
 }
 
 type acceptReply struct {
@@ -36,6 +40,8 @@ type accept struct {
 	orderID    uint64
 	operatorID uint64
 	reply      chan acceptReply
+	// Accepted outside of manager loop by follower, strategy should be informed through leader
+	follower bool
 }
 
 type opPush struct {
@@ -54,9 +60,11 @@ var manager = orderManager{
 	orders:    make(chan orderPush),
 	operators: make(chan opPush),
 	accepts:   make(chan accept),
+	accepted:  make(chan accept),
 }
 
 func StartOrderManager() {
+	manager.strategy = newDispatchStrategy(conf.Dispatch.Strategy)
 	// load list of new orders and push it to manager
 	go func() {
 		var orders []Order
@@ -97,6 +105,9 @@ func (man *orderManager) loop() {
 
 		case accept := <-man.accepts:
 			man.acceptOrder(accept)
+
+		case accept := <-man.accepted:
+			man.onFollowerAccept(accept)
 		}
 	}
 }
@@ -146,11 +157,36 @@ func (man *orderManager) onOperatorReceive(push opPush) {
 		return
 	}
 
+	available, err := op.AvailableDeposit(tx)
+	if err != nil {
+		tx.Rollback()
+		log.Errorf("failed to load pending withdrawals of operator %v: %v", op.ID, err)
+		go requeue(push)
+		return
+	}
+
+	// Orders up to this one should not be rechecked later
+	considered := op.CurrentOrder
+	deferred := false
 	for _, order := range orders {
-		if op.Deposit.Cmp(order.LBAmount) > 0 {
+		if available.Cmp(order.LBAmount) > 0 {
+			selected, err := man.selects(tx, order, op)
+			if err != nil {
+				tx.Rollback()
+				log.Errorf("failed to dispatch order %v: %v", order.ID, err)
+				go requeue(push)
+				return
+			}
+			// Strategy wants to offer this order to someone else for now,
+			// operator will get it later on order redispatch if nobody accepts it
+			if !selected {
+				deferred = true
+				continue
+			}
+
 			op.CurrentOrder = order.ID
 			op.Status = proto.OperatorStatus_Proposal
-			err := op.Save(tx)
+			err = op.Save(tx)
 			if err != nil {
 				tx.Rollback()
 				log.Errorf("failed to save operator: %v", err)
@@ -158,10 +194,7 @@ func (man *orderManager) onOperatorReceive(push opPush) {
 				return
 			}
 
-			err = rabbit.Publish("offer_event", "", tg.OfferEvent{
-				Chats: []int64{op.TelegramChat},
-				Order: order.Encode(),
-			})
+			err = enqueueOfferEvent(tx, []int64{op.TelegramChat}, order)
 			if err != nil {
 				tx.Rollback()
 				log.Errorf("failed to send offer to %v: %v", op.ID, err)
@@ -180,9 +213,12 @@ func (man *orderManager) onOperatorReceive(push opPush) {
 			// @TODO it can be kinda spammy. Combine notifies?
 			go NotifyLackOfDeposit(op.TelegramChat, order.LBAmount)
 		}
+		if !deferred {
+			considered = order.ID
+		}
 	}
 
-	op.CurrentOrder = orders[len(orders)-1].ID
+	op.CurrentOrder = considered
 	err = op.Save(tx)
 	if err != nil {
 		tx.Rollback()
@@ -241,18 +277,34 @@ func (man *orderManager) onOrderReceive(push orderPush) {
 		return
 	}
 
-	var offer_ids, lack_ids []uint64
-	var offer_chats, lack_chats []int64
+	available, err := AvailableDeposits(tx, ops)
+	if err != nil {
+		tx.Rollback()
+		log.Errorf("failed to load pending withdrawals: %v", err)
+		go requeue(push.id, true)
+		return
+	}
+
+	var candidates []Operator
+	var lack_ids []uint64
+	var lack_chats []int64
 	for _, op := range ops {
-		if op.Deposit.Cmp(order.LBAmount) >= 0 {
-			offer_ids = append(offer_ids, op.ID)
-			offer_chats = append(offer_chats, op.TelegramChat)
+		if available[op.ID].Cmp(order.LBAmount) >= 0 {
+			candidates = append(candidates, op)
 		} else if push.notify {
 			lack_ids = append(lack_ids, op.ID)
 			lack_chats = append(lack_chats, op.TelegramChat)
 		}
 	}
 
+	selected := man.strategy.Select(order, candidates, dispatchProgress(order))
+	var offer_ids []uint64
+	var offer_chats []int64
+	for _, op := range selected {
+		offer_ids = append(offer_ids, op.ID)
+		offer_chats = append(offer_chats, op.TelegramChat)
+	}
+
 	err = tx.Model(&Operator{}).Where("id in (?)", offer_ids).Updates(map[string]interface{}{
 		"status":        proto.OperatorStatus_Proposal,
 		"current_order": order.ID,
@@ -285,10 +337,7 @@ func (man *orderManager) onOrderReceive(push orderPush) {
 		return
 	}
 
-	err = rabbit.Publish("offer_event", "", tg.OfferEvent{
-		Chats: offer_chats,
-		Order: order.Encode(),
-	})
+	err = enqueueOfferEvent(tx, offer_chats, order)
 	if err != nil {
 		tx.Rollback()
 		log.Errorf("failed to send offer event: %v", err)
@@ -302,6 +351,39 @@ func (man *orderManager) onOrderReceive(push orderPush) {
 		go requeue(push.id, false)
 		return
 	}
+
+	// Widen offer later
+	if len(selected) < len(candidates) {
+		go requeue(push.id, false)
+	}
+}
+
+// Checks whether dispatch strategy would offer order to operator at the moment
+func (man *orderManager) selects(tx *gorm.DB, order Order, op Operator) (bool, error) {
+	var ready []Operator
+	err := tx.Find(&ready, "status = ? AND current_order < ? AND deposit >= ? AND id != ?",
+		proto.OperatorStatus_Ready, order.ID, order.LBAmount, op.ID).Error
+	if err != nil {
+		return false, err
+	}
+	available, err := AvailableDeposits(tx, ready)
+	if err != nil {
+		return false, err
+	}
+	var candidates []Operator
+	for _, candidate := range ready {
+		if available[candidate.ID].Cmp(order.LBAmount) >= 0 {
+			candidates = append(candidates, candidate)
+		}
+	}
+	candidates = append(candidates, op)
+
+	for _, selected := range man.strategy.Select(order, candidates, dispatchProgress(order)) {
+		if selected.ID == op.ID {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (man *orderManager) tickUpdate() {
@@ -343,9 +425,18 @@ func (man *orderManager) tickUpdate() {
 			log.Fatalf("unreachable point")
 		}
 	}
+
+	sendDeadlineWarnings()
 }
 
 func (man *orderManager) PushOrder(orderID uint64) {
+	if !IsLeader() {
+		forwardToLeader(managerPush{
+			Kind:    managerPush_Order,
+			OrderID: orderID,
+		})
+		return
+	}
 	man.orders <- orderPush{
 		id:     orderID,
 		notify: true,
@@ -353,6 +444,14 @@ func (man *orderManager) PushOrder(orderID uint64) {
 }
 
 func (man *orderManager) PushOperator(opID uint64, anew bool) {
+	if !IsLeader() {
+		forwardToLeader(managerPush{
+			Kind:       managerPush_Operator,
+			OperatorID: opID,
+			Anew:       anew,
+		})
+		return
+	}
 	man.operators <- opPush{
 		id:   opID,
 		anew: anew,
@@ -360,12 +459,19 @@ func (man *orderManager) PushOperator(opID uint64, anew bool) {
 }
 
 func (man *orderManager) AcceptOffer(operatorID, orderID uint64) (Order, error) {
-	reply := make(chan acceptReply)
-	man.accepts <- accept{
+	reply := make(chan acceptReply, 1)
+	req := accept{
 		operatorID: operatorID,
 		orderID:    orderID,
 		reply:      reply,
 	}
+	if IsLeader() {
+		man.accepts <- req
+	} else {
+		// Accept is protected by row locks, so follower can do it by itself
+		req.follower = true
+		man.acceptOrder(req)
+	}
 	ret := <-reply
 	return ret.order, ret.err
 }
@@ -411,11 +517,20 @@ func (man *orderManager) acceptOrder(accept accept) {
 		return
 	}
 
-	if op.Deposit.Cmp(order.LBAmount) < 0 {
+	available, err := op.AvailableDeposit(tx)
+	if err != nil {
+		tx.Rollback()
+		log.Errorf("failed to load pending withdrawals of operator %v: %v", accept.operatorID, err)
+		accept.reply <- acceptReply{
+			err: errors.New(proto.DBError),
+		}
+		return
+	}
+	if available.Cmp(order.LBAmount) < 0 {
 		tx.Rollback()
 		log.Errorf("operator %v tried to accept order %v but do not have enough on deposit", accept.operatorID, order.ID)
 		accept.reply <- acceptReply{
-			err: errors.New("lack of deposit"),
+			err: errors.New(proto.LackOfDepositError),
 		}
 		return
 	}
@@ -481,7 +596,7 @@ func (man *orderManager) acceptOrder(accept accept) {
 
 	order.OperatorID = op.ID
 	order.Status = proto.OrderStatus_Accepted
-	err = order.Save(tx)
+	err = order.Save(tx, OperatorActor(op.ID), "offer accepted")
 	if err != nil {
 		tx.Rollback()
 		accept.reply <- acceptReply{
@@ -490,12 +605,14 @@ func (man *orderManager) acceptOrder(accept accept) {
 		return
 	}
 
-	err = rabbit.Publish("offer_event", "", tg.OfferEvent{
-		Chats: chats,
-		Order: order.Encode(),
-	})
+	err = enqueueOfferEvent(tx, chats, order)
 	if err != nil {
 		log.Errorf("failed to send reject offer event: %v", err)
+		tx.Rollback()
+		accept.reply <- acceptReply{
+			err: errors.New(proto.DBError),
+		}
+		return
 	}
 
 	err = tx.Commit().Error
@@ -507,11 +624,35 @@ func (man *orderManager) acceptOrder(accept accept) {
 		return
 	}
 
+	if !accept.follower {
+		man.strategy.Accepted(order, op)
+	} else {
+		forwardToLeader(managerPush{
+			Kind:       managerPush_Accepted,
+			OrderID:    order.ID,
+			OperatorID: op.ID,
+		})
+	}
+
 	accept.reply <- acceptReply{
 		order: order,
 	}
 }
 
+func (man *orderManager) onFollowerAccept(accept accept) {
+	var order Order
+	var op Operator
+	err := db.New().First(&order, "id = ?", accept.orderID).Error
+	if err == nil {
+		err = db.New().First(&op, "id = ?", accept.operatorID).Error
+	}
+	if err != nil {
+		log.Errorf("failed to load order %v accepted by %v: %v", accept.orderID, accept.operatorID, err)
+		return
+	}
+	man.strategy.Accepted(order, op)
+}
+
 func rejectOrder(orderID uint64) error {
 	tx := db.NewTransaction()
 
@@ -549,18 +690,16 @@ func rejectOrder(orderID uint64) error {
 	}
 
 	order.Status = proto.OrderStatus_Rejected
-	err = order.Save(tx)
+	err = order.Save(tx, TimeoutActor, "no operator accepted order in time")
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed to save order: %v", err)
 	}
 
-	err = rabbit.Publish("offer_event", "", tg.OfferEvent{
-		Chats: chats,
-		Order: order.Encode(),
-	})
+	err = enqueueOfferEvent(tx, chats, order)
 	if err != nil {
-		log.Errorf("failed to send reject offer event: %v", err)
+		tx.Rollback()
+		return fmt.Errorf("failed to send reject offer event: %v", err)
 	}
 
 	return tx.Commit().Error
@@ -594,7 +733,7 @@ func timeoutOrder(orderID uint64) error {
 	}
 
 	order.Status = proto.OrderStatus_Timeout
-	err = order.Save(tx)
+	err = order.Save(tx, TimeoutActor, "payment was not received in time")
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed to save order: %v", err)
@@ -616,7 +755,7 @@ func extendConfirmation(orderID uint64) error {
 	}
 
 	order.Status = proto.OrderStatus_ConfirmationExtended
-	err = order.Save(tx)
+	err = order.Save(tx, TimeoutActor, "payment was not confirmed in time")
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed to save order: %v", err)
@@ -3,12 +3,26 @@ package main
 import (
 	"common/db"
 	"common/log"
+	"core/proto"
 )
 
 var models = []interface{}{
 	&LBTransaction{},
 	&Operator{},
 	&Order{},
+	&OrderHistory{},
+	&OutboxEvent{},
+	&OrderEventSeq{},
+	&Payout{},
+	&PayoutAttempt{},
+	&DepositEntry{},
+	&Withdrawal{},
+	&Quote{},
+	&OrderLimit{},
+	&FeeTier{},
+	&PricingRule{},
+	&SentOrderWarning{},
+	&RateSnapshot{},
 }
 
 func migrate(drop bool) {
@@ -23,5 +37,20 @@ func migrate(drop bool) {
 	log.Fatal(tx.Model(&LBTransaction{}).AddUniqueIndex("unique_transaction",
 		"created_at", "direction", "amount", "description").Error)
 
+	// Operators which had deposit before ledger was introduced
+	var ops []Operator
+	log.Fatal(tx.Where(
+		"deposit != 0 AND NOT EXISTS (SELECT 1 FROM deposit_entries WHERE operator_id = operators.id)",
+	).Find(&ops).Error)
+	for _, op := range ops {
+		log.Fatal(tx.Create(&DepositEntry{
+			OperatorID: op.ID,
+			Type:       proto.DepositEntryType_Opening,
+			Amount:     op.Deposit,
+			Balance:    op.Deposit,
+			Comment:    "deposit before ledger was introduced",
+		}).Error)
+	}
+
 	log.Fatal(tx.Commit().Error)
 }
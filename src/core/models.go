@@ -6,8 +6,10 @@ import (
 	"common/rabbit"
 	"core/proto"
 	"github.com/jinzhu/gorm"
+	"github.com/qor/qor"
 	"github.com/shopspring/decimal"
 	"lbapi"
+	"strconv"
 	"time"
 )
 
@@ -41,12 +43,18 @@ type Operator struct {
 	Status   proto.OperatorStatus
 	lbapi.Key
 
-	TelegramChat int64           `gorm:"unique_index"`
-	Deposit      decimal.Decimal `gorm:"type:decimal;index"`
-	Note         string          `gorm:"text"`
+	TelegramChat int64 `gorm:"unique_index"`
+	// Cached sum of deposit ledger entries, see DepositEntry
+	Deposit decimal.Decimal `gorm:"type:decimal;index"`
+	Note    string          `gorm:"text"`
 
 	// @TODO extra consistency checks in db?
 	CurrentOrder uint64 `gorm:"index"`
+
+	// Zero for default fee
+	FeeTierID uint64 `gorm:"index"`
+	// Tier is assigned by admin and is not changed automatically
+	FeeTierManual bool
 }
 
 func (op Operator) Encode() proto.Operator {
@@ -79,8 +87,74 @@ func (op *Operator) Save(tx *gorm.DB) error {
 	return err
 }
 
-func (op Operator) ChangeDeposit(tx *gorm.DB, amount decimal.Decimal) error {
-	return tx.Model(&op).Update("deposit", gorm.Expr("deposit + ?", amount)).Error
+// Applies entry to operator deposit and saves it to ledger.
+// Amount, type, references and comment should be filled by caller
+func (op Operator) ChangeDeposit(tx *gorm.DB, entry DepositEntry) (DepositEntry, error) {
+	err := tx.Model(&op).Update("deposit", gorm.Expr("deposit + ?", entry.Amount)).Error
+	if err != nil {
+		return entry, err
+	}
+	// Row is locked by update above, so it is safe to read it here
+	err = tx.Model(&Operator{}).Where("id = ?", op.ID).Select("deposit").Row().Scan(&entry.Balance)
+	if err != nil {
+		return entry, err
+	}
+	entry.OperatorID = op.ID
+	err = tx.Create(&entry).Error
+	return entry, err
+}
+
+// Sets cached deposit value to sum of ledger entries
+func RecomputeDeposit(tx *gorm.DB, operatorID uint64) (decimal.Decimal, error) {
+	var sum decimal.Decimal
+	err := tx.Model(&DepositEntry{}).Where("operator_id = ?", operatorID).
+		Select("coalesce(sum(amount), 0)").Row().Scan(&sum)
+	if err != nil {
+		return sum, err
+	}
+	err = tx.Model(&Operator{}).Where("id = ?", operatorID).Update("deposit", sum).Error
+	return sum, err
+}
+
+// Record of operator deposit ledger.
+// Deposit of operator is always equal to sum of amounts of related entries
+type DepositEntry struct {
+	ID         uint64
+	OperatorID uint64                 `gorm:"index"`
+	Type       proto.DepositEntryType `gorm:"index"`
+	// Negative for write-offs
+	Amount decimal.Decimal `gorm:"type:decimal"`
+	// Deposit after entry was applied
+	Balance decimal.Decimal `gorm:"type:decimal"`
+	// References, which one is filled depends on type
+	LBTransactionID uint64 `gorm:"index"`
+	OrderID         uint64 `gorm:"index"`
+	WithdrawalID    uint64 `gorm:"index"`
+	Admin           string
+	Comment         string `gorm:"text"`
+	CreatedAt       time.Time
+}
+
+func (entry DepositEntry) Encode() proto.DepositEntry {
+	return proto.DepositEntry{
+		ID:              entry.ID,
+		OperatorID:      entry.OperatorID,
+		Type:            entry.Type,
+		Amount:          entry.Amount,
+		Balance:         entry.Balance,
+		LBTransactionID: entry.LBTransactionID,
+		OrderID:         entry.OrderID,
+		WithdrawalID:    entry.WithdrawalID,
+		Admin:           entry.Admin,
+		Comment:         entry.Comment,
+		CreatedAt:       entry.CreatedAt,
+	}
+}
+
+func LoadDepositLedger(db *gorm.DB, operatorID uint64) ([]DepositEntry, error) {
+	var ledger []DepositEntry
+	err := db.Order("id").Find(&ledger, "operator_id = ?", operatorID).Error
+	return ledger, err
 }
 
 type LBTransaction struct {
@@ -114,6 +188,36 @@ type Order struct {
 	// According to client
 	MarkedPayedAt time.Time
 	ConfirmedAt   time.Time
+	LBDisputedAt  time.Time
+	// Bot fee of quote is kept on order if it is set, quoted operator fee caps fee of operator tier
+	QuoteID uint64
+	// Fee tier of operator applied to order, zero for default fee
+	FeeTierID uint64
+	// Pricing rule applied to order, zero for default pricing
+	PricingRuleID uint64
+	// Rate order was priced with at creation
+	RateSnapshotID uint64
+	// Rate is derived from other currency
+	DerivedRate bool
+	// Client or lb if related contact was canceled, zero unless order is canceled
+	CanceledBy proto.ActorKind
+
+	DisputedAt     time.Time
+	DisputedBy     proto.ActorKind
+	DisputeReason  string `gorm:"type:text"`
+	DisputeVerdict proto.DisputeVerdict
+	// Written verdict of admin
+	DisputeComment string `gorm:"type:text"`
+	// Part of payout which goes to client on split verdict, from 0 to 1
+	DisputeClientPart decimal.Decimal `gorm:"type:decimal"`
+
+	// Status as it was loaded from db, used to detect status changes on save
+	loadedStatus proto.OrderStatus
+}
+
+func (order *Order) AfterFind() error {
+	order.loadedStatus = order.Status
+	return nil
 }
 
 func (order *Order) LockLoad(tx *gorm.DB) error {
@@ -126,19 +230,34 @@ func LockLoadOrderByID(tx *gorm.DB, id uint64) (Order, error) {
 	return order, err
 }
 
-func (order *Order) Save(db *gorm.DB) error {
+// Saves order and writes history record if status was changed since load
+func (order *Order) Save(db *gorm.DB, actor Actor, reason string) error {
 	err := db.Save(order).Error
 	if err != nil {
 		log.Errorf("failed to save order %v: %v", order.ID, err)
 		return err
 	}
 
-	err = rabbit.Publish("order_event", "", order.Encode())
+	if order.Status != order.loadedStatus {
+		err = db.Create(&OrderHistory{
+			OrderID:   order.ID,
+			OldStatus: order.loadedStatus,
+			NewStatus: order.Status,
+			ActorKind: actor.Kind,
+			Actor:     actor.Name,
+			Reason:    reason,
+		}).Error
+		if err != nil {
+			log.Errorf("failed to save history of order %v: %v", order.ID, err)
+			return err
+		}
+		order.loadedStatus = order.Status
+	}
+
+	err = enqueueOrderEvent(db, *order)
 	if err != nil {
-		log.Errorf("failed to send order event: %v", err)
-		// Still saved, so it kind of success
-		// In other hand transaction could be passed here...
-		// return err
+		log.Errorf("failed to enqueue event of order %v: %v", order.ID, err)
+		return err
 	}
 	return nil
 }
@@ -147,21 +266,204 @@ func (order Order) OutletAmount() decimal.Decimal {
 	return order.LBAmount.Sub(order.LBFee).Sub(order.OperatorFee).Sub(order.BotFee)
 }
 
+// Part of order which is settled: everything unless dispute was split
+func (order Order) settledPart() decimal.Decimal {
+	if order.DisputeVerdict == proto.DisputeVerdict_Split {
+		return order.DisputeClientPart
+	}
+	return decimal.New(1, 0)
+}
+
+// Amount transferred to client
+func (order Order) PayoutAmount() decimal.Decimal {
+	return order.OutletAmount().Mul(order.settledPart())
+}
+
+// Operator fee of settled part of order
+func (order Order) SettledOperatorFee() decimal.Decimal {
+	return order.OperatorFee.Mul(order.settledPart())
+}
+
+// Amount written-off from operator deposit on confirmation: contact_sum - lb_fee - op_fee of settled part
+func (order Order) WriteOffAmount() decimal.Decimal {
+	return order.LBAmount.Sub(order.LBFee).Sub(order.OperatorFee).Mul(order.settledPart())
+}
+
 func (order Order) Encode() proto.Order {
 	return proto.Order{
-		ID:                order.ID,
-		ClientName:        order.ClientName,
-		Destination:       order.Destination,
-		PaymentMethod:     order.PaymentMethod,
-		Currency:          order.Currency,
-		FiatAmount:        order.FiatAmount,
-		PaymentRequisites: order.PaymentRequisites,
-		LBContractID:      order.LBContactID,
-		LBAmount:          order.LBAmount,
-		LBFee:             order.LBFee,
-		OperatorFee:       order.OperatorFee,
-		BotFee:            order.BotFee,
-		Status:            order.Status,
-		OperatorID:        order.OperatorID,
+		ID:                 order.ID,
+		ClientName:         order.ClientName,
+		Destination:        order.Destination,
+		PaymentMethod:      order.PaymentMethod,
+		Currency:           order.Currency,
+		FiatAmount:         order.FiatAmount,
+		PaymentRequisites:  order.PaymentRequisites,
+		LBContractID:       order.LBContactID,
+		LBAmount:           order.LBAmount,
+		LBFee:              order.LBFee,
+		OperatorFee:        order.OperatorFee,
+		SettledOperatorFee: order.SettledOperatorFee(),
+		WriteOffAmount:     order.WriteOffAmount(),
+		BotFee:             order.BotFee,
+		Status:             order.Status,
+		OperatorID:         order.OperatorID,
+		LBDisputedAt:       order.LBDisputedAt,
+		QuoteID:            order.QuoteID,
+		DerivedRate:        order.DerivedRate,
+		CanceledBy:         order.CanceledBy,
+		DisputedAt:         order.DisputedAt,
+		DisputedBy:         order.DisputedBy,
+		DisputeReason:      order.DisputeReason,
+		DisputeVerdict:     order.DisputeVerdict,
+		DisputeComment:     order.DisputeComment,
+		AcceptBy:           deadlineAfter(order.CreatedAt, conf.OrderTimeouts.Accept),
+		PayBy:              deadlineAfter(order.PaymentRequestedAt, conf.OrderTimeouts.Payment),
+		ConfirmBy:          deadlineAfter(order.MarkedPayedAt, conf.OrderTimeouts.Confirm),
+	}
+}
+
+type Actor struct {
+	Kind proto.ActorKind
+	// Operator id, client address or admin name depending on kind
+	Name string
+}
+
+var (
+	TimeoutActor = Actor{Kind: proto.ActorKind_Timeout}
+	LBActor      = Actor{Kind: proto.ActorKind_LB}
+	PayoutActor  = Actor{Kind: proto.ActorKind_System, Name: "payout"}
+)
+
+func OperatorActor(operatorID uint64) Actor {
+	return Actor{
+		Kind: proto.ActorKind_Operator,
+		Name: strconv.FormatUint(operatorID, 10),
+	}
+}
+
+func ClientActor(address string) Actor {
+	return Actor{
+		Kind: proto.ActorKind_Client,
+		Name: address,
+	}
+}
+
+func AdminActor(user qor.CurrentUser) Actor {
+	actor := Actor{Kind: proto.ActorKind_Admin}
+	if user != nil {
+		actor.Name = user.DisplayName()
+	}
+	return actor
+}
+
+// One record per order status change
+type OrderHistory struct {
+	ID        uint64
+	OrderID   uint64 `gorm:"index"`
+	OldStatus proto.OrderStatus
+	NewStatus proto.OrderStatus
+	ActorKind proto.ActorKind
+	Actor     string
+	Reason    string `gorm:"text"`
+	CreatedAt time.Time
+}
+
+func (h OrderHistory) Encode() proto.OrderHistoryRecord {
+	return proto.OrderHistoryRecord{
+		OrderID:   h.OrderID,
+		OldStatus: h.OldStatus,
+		NewStatus: h.NewStatus,
+		ActorKind: h.ActorKind,
+		Actor:     h.Actor,
+		Reason:    h.Reason,
+		CreatedAt: h.CreatedAt,
+	}
+}
+
+func LoadOrderHistory(db *gorm.DB, orderID uint64) ([]OrderHistory, error) {
+	var history []OrderHistory
+	err := db.Order("id").Find(&history, "order_id = ?", orderID).Error
+	return history, err
+}
+
+type Withdrawal struct {
+	db.Model
+	OperatorID uint64          `gorm:"index"`
+	Amount     decimal.Decimal `gorm:"type:decimal"`
+	// Bitcoin address
+	Address string
+	Status  proto.WithdrawalStatus `gorm:"index"`
+	// Admin who approved or rejected withdrawal
+	Admin  string
+	SentAt time.Time
+	// Error of send if withdrawal is stuck in sending status
+	Message string `gorm:"text"`
+}
+
+func (w Withdrawal) Encode() proto.Withdrawal {
+	return proto.Withdrawal{
+		ID:         w.ID,
+		OperatorID: w.OperatorID,
+		Amount:     w.Amount,
+		Address:    w.Address,
+		Status:     w.Status,
+		CreatedAt:  w.CreatedAt,
+	}
+}
+
+func LockLoadWithdrawalByID(tx *gorm.DB, id uint64) (Withdrawal, error) {
+	w := Withdrawal{Model: db.Model{ID: id}}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where(&w).First(&w).Error
+	return w, err
+}
+
+// Withdrawals which are not written-off yet, but reserve part of deposit
+var pendingWithdrawalStatuses = []proto.WithdrawalStatus{
+	proto.WithdrawalStatus_Pending,
+	proto.WithdrawalStatus_Sending,
+}
+
+// Sum of pending and not yet written-off sending withdrawals of operator
+func PendingWithdrawals(tx *gorm.DB, operatorID uint64) (decimal.Decimal, error) {
+	var sum decimal.Decimal
+	err := tx.Model(&Withdrawal{}).
+		Where("operator_id = ? AND status IN (?)", operatorID, pendingWithdrawalStatuses).
+		Select("coalesce(sum(amount), 0)").Row().Scan(&sum)
+	return sum, err
+}
+
+// Deposits of operators which can back orders, i.e. without pending withdrawals
+func AvailableDeposits(tx *gorm.DB, ops []Operator) (map[uint64]decimal.Decimal, error) {
+	ret := make(map[uint64]decimal.Decimal, len(ops))
+	if len(ops) == 0 {
+		return ret, nil
+	}
+	for _, op := range ops {
+		ret[op.ID] = op.Deposit
+	}
+	var rows []struct {
+		OperatorID uint64
+		Pending    decimal.Decimal
+	}
+	err := tx.Model(&Withdrawal{}).
+		Select("operator_id, coalesce(sum(amount), 0) as pending").
+		Where("operator_id in (?) AND status IN (?)", operatorIDs(ops), pendingWithdrawalStatuses).
+		Group("operator_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		ret[row.OperatorID] = ret[row.OperatorID].Sub(row.Pending)
+	}
+	return ret, nil
+}
+
+// Deposit of operator which can back orders, i.e. without pending withdrawals
+func (op Operator) AvailableDeposit(tx *gorm.DB) (decimal.Decimal, error) {
+	pending, err := PendingWithdrawals(tx, op.ID)
+	if err != nil {
+		return decimal.Zero, err
 	}
+	return op.Deposit.Sub(pending), nil
 }
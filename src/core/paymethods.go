@@ -0,0 +1,70 @@
+package main
+
+import (
+	"core/proto"
+	"lbapi"
+	"sort"
+	"sync"
+)
+
+// Catalog of lb payment methods, loaded on start just like CurrencyList
+var paymentMethods = struct {
+	sync.RWMutex
+	// method code -> method
+	byCode map[string]lbapi.PaymentMethod
+	// method code -> set of supported currencies, nil set means any currency
+	currencies map[string]map[string]bool
+}{}
+
+func SetPaymentMethods(methods []lbapi.PaymentMethod) {
+	byCode := map[string]lbapi.PaymentMethod{}
+	currencies := map[string]map[string]bool{}
+	for _, method := range methods {
+		byCode[method.Code] = method
+		if len(method.Currencies) == 0 {
+			continue
+		}
+		set := map[string]bool{}
+		for _, cur := range method.Currencies {
+			set[cur] = true
+		}
+		currencies[method.Code] = set
+	}
+
+	paymentMethods.Lock()
+	paymentMethods.byCode = byCode
+	paymentMethods.currencies = currencies
+	paymentMethods.Unlock()
+}
+
+func IsKnownPaymentMethod(method, currency string) bool {
+	paymentMethods.RLock()
+	defer paymentMethods.RUnlock()
+	if _, ok := paymentMethods.byCode[method]; !ok {
+		return false
+	}
+	set, ok := paymentMethods.currencies[method]
+	return !ok || set[currency]
+}
+
+// Returns methods available for currency, or all methods if currency is empty
+func ListPaymentMethods(currency string) ([]proto.PaymentMethod, error) {
+	paymentMethods.RLock()
+	ret := make([]proto.PaymentMethod, 0, len(paymentMethods.byCode))
+	for code, method := range paymentMethods.byCode {
+		if set, ok := paymentMethods.currencies[code]; currency != "" && ok && !set[currency] {
+			continue
+		}
+		ret = append(ret, proto.PaymentMethod{
+			Code:       method.Code,
+			Name:       method.Name,
+			Currencies: method.Currencies,
+		})
+	}
+	paymentMethods.RUnlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"common/db"
+	"common/log"
+	"common/rabbit"
+	"core/proto"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/shopspring/decimal"
+	"time"
+)
+
+// Outbox of bitshares transfers. Row is written in the same transaction which confirms order,
+// transfer is made by dispatcher and its result is applied to order in separate step.
+type Payout struct {
+	db.Model
+	OrderID uint64 `gorm:"unique_index"`
+	// Sent to payer, which must not transfer twice with the same id
+	PayoutID      string `gorm:"unique_index"`
+	Destination   string
+	Amount        decimal.Decimal `gorm:"type:decimal"`
+	Status        proto.PayoutStatus
+	Attempts      uint
+	NextAttemptAt time.Time
+	// Result of last attempt
+	Message string `gorm:"text"`
+	// Retry requested by admin, failure of it will not be retried automatically
+	Manual bool
+	// Whether result is applied to order
+	Applied bool
+}
+
+func LockLoadPayoutByOrder(tx *gorm.DB, orderID uint64) (Payout, error) {
+	var payout Payout
+	err := tx.Set("gorm:query_option", "FOR UPDATE").First(&payout, "order_id = ?", orderID).Error
+	return payout, err
+}
+
+func LoadPayoutByOrder(db *gorm.DB, orderID uint64) (Payout, error) {
+	var payout Payout
+	err := db.First(&payout, "order_id = ?", orderID).Error
+	return payout, err
+}
+
+func createPayout(tx *gorm.DB, order Order) error {
+	return tx.Create(&Payout{
+		OrderID:       order.ID,
+		PayoutID:      fmt.Sprintf("order-%v", order.ID),
+		Destination:   order.Destination,
+		Amount:        order.PayoutAmount(),
+		Status:        proto.PayoutStatus_Pending,
+		NextAttemptAt: time.Now(),
+	}).Error
+}
+
+// Every bitshares transfer made for order
+type PayoutAttempt struct {
+	ID        uint64
+	OrderID   uint64 `gorm:"index"`
+	Success   bool
+	Message   string `gorm:"text"`
+	ActorKind proto.ActorKind
+	Actor     string
+	CreatedAt time.Time
+}
+
+func LoadPayoutAttempts(db *gorm.DB, orderID uint64) ([]PayoutAttempt, error) {
+	var attempts []PayoutAttempt
+	err := db.Order("id").Find(&attempts, "order_id = ?", orderID).Error
+	return attempts, err
+}
+
+// Delay before next transfer after passed number of failed ones
+func payoutBackoff(attempts uint) time.Duration {
+	delay := conf.PayoutRetry.BaseDelay
+	for i := uint(1); i < attempts && delay < conf.PayoutRetry.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > conf.PayoutRetry.MaxDelay {
+		delay = conf.PayoutRetry.MaxDelay
+	}
+	return delay
+}
+
+var payoutsKick = make(chan struct{}, 1)
+
+// Wakes up dispatcher without waiting for next tick
+func kickPayouts() {
+	select {
+	case payoutsKick <- struct{}{}:
+	default:
+	}
+}
+
+func PayoutDispatcherLoop() {
+	ticker := time.NewTicker(conf.PayoutRetry.Tick)
+	for {
+		dispatchPayouts()
+		applyPayouts()
+		select {
+		case <-ticker.C:
+		case <-payoutsKick:
+		}
+	}
+}
+
+func dispatchPayouts() {
+	var ids []uint64
+	err := db.New().Model(&Payout{}).
+		Where("status = ? AND next_attempt_at <= ?", proto.PayoutStatus_Pending, time.Now()).
+		Order("id").
+		Pluck("id", &ids).Error
+	if err != nil {
+		log.Errorf("failed to load pending payouts: %v", err)
+		return
+	}
+	for _, id := range ids {
+		err := sendPayout(id)
+		if err != nil {
+			log.Errorf("failed to send payout %v: %v", id, err)
+		}
+	}
+}
+
+// Makes transfer for pending payout. Payout row is locked until result is saved,
+// so concurrent admin actions wait for it.
+func sendPayout(id uint64) error {
+	tx := db.NewTransaction()
+	var payout Payout
+	err := tx.Set("gorm:query_option", "FOR UPDATE").First(&payout, "id = ?", id).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load payout: %v", err)
+	}
+	if payout.Status != proto.PayoutStatus_Pending || payout.NextAttemptAt.After(time.Now()) {
+		tx.Rollback()
+		return nil
+	}
+
+	attempt := PayoutAttempt{
+		OrderID:   payout.OrderID,
+		ActorKind: PayoutActor.Kind,
+		Actor:     PayoutActor.Name,
+	}
+	response, err := ProcessPayment(proto.BitsharesPaymentRequest{
+		PayoutID: payout.PayoutID,
+		Name:     payout.Destination,
+		Amount:   payout.Amount,
+	})
+	// Request could reach payer even if response was lost, so transfer may be made already
+	uncertain := false
+	switch {
+	case err != nil:
+		if rpcErr, ok := err.(rabbit.RPCError); ok && rpcErr.Kind == rabbit.RPCError_Forwarded {
+			attempt.Message = fmt.Sprintf("bitshares transfer failed: %v", err)
+			break
+		}
+		uncertain = true
+		attempt.Message = fmt.Sprintf("payment service did not respond, check account history before retry: %v", err)
+	case response.AlreadySent:
+		attempt.Success = true
+		attempt.Message = "bitshares transfer was already made"
+	case response.Uncertain:
+		uncertain = true
+		attempt.Message = fmt.Sprintf("bitshares transfer result is unknown, check account history: %v", response.Message)
+	case !response.Success:
+		attempt.Message = fmt.Sprintf("bitshares transfer failed: %v", response.Message)
+	default:
+		attempt.Success = true
+		attempt.Message = "bitshares transfer completed"
+	}
+
+	payout.Attempts++
+	payout.Message = attempt.Message
+	switch {
+	case attempt.Success:
+		payout.Status = proto.PayoutStatus_Sent
+	// Uncertain transfers are not retried automatically, admin should check them
+	case uncertain, payout.Manual, payout.Attempts >= conf.PayoutRetry.MaxAttempts:
+		payout.Status = proto.PayoutStatus_Failed
+	default:
+		payout.NextAttemptAt = time.Now().Add(payoutBackoff(payout.Attempts))
+	}
+	payout.Manual = false
+
+	err = tx.Create(&attempt).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save payout attempt: %v", err)
+	}
+	err = tx.Save(&payout).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save payout: %v", err)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		// Transfer will be repeated with the same payout id, so payer will report it as already sent
+		log.Errorf("payout %v of order %v was attempted, but commit failed: %v", payout.ID, payout.OrderID, err)
+		return err
+	}
+	return nil
+}
+
+func applyPayouts() {
+	var ids []uint64
+	err := db.New().Model(&Payout{}).
+		Where("NOT applied AND status IN (?)", []proto.PayoutStatus{proto.PayoutStatus_Sent, proto.PayoutStatus_Failed}).
+		Order("id").
+		Pluck("order_id", &ids).Error
+	if err != nil {
+		log.Errorf("failed to load payout results: %v", err)
+		return
+	}
+	for _, id := range ids {
+		err := applyPayout(id)
+		if err != nil {
+			log.Errorf("failed to apply payout result to order %v: %v", id, err)
+		}
+	}
+}
+
+// Moves order to finished or payout failed status according to payout result
+func applyPayout(orderID uint64) error {
+	tx := db.NewTransaction()
+	order, err := LockLoadOrderByID(tx, orderID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load order: %v", err)
+	}
+	payout, err := LockLoadPayoutByOrder(tx, orderID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load payout: %v", err)
+	}
+	if payout.Applied {
+		tx.Rollback()
+		return nil
+	}
+
+	if order.Status == proto.OrderStatus_Transfer || order.Status == proto.OrderStatus_PayoutFailed {
+		switch payout.Status {
+		case proto.PayoutStatus_Sent:
+			order.Status = proto.OrderStatus_Finished
+		case proto.PayoutStatus_Failed:
+			order.Status = proto.OrderStatus_PayoutFailed
+		}
+		err = order.Save(tx, PayoutActor, payout.Message)
+		if err != nil {
+			tx.Rollback()
+			return errors.New(proto.DBError)
+		}
+	} else {
+		log.Warn(fmt.Sprintf("payout of order %v is %v, but order have status '%v'", orderID, payout.Status, order.Status))
+	}
+
+	payout.Applied = true
+	err = tx.Save(&payout).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save payout: %v", err)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+
+	if payout.Status == proto.PayoutStatus_Failed {
+		notifyPayoutFailed(payout, payout.Message)
+	}
+	return nil
+}
+
+// Schedules immediate transfer for order in transfer or payout failed status
+func retryPayout(orderID uint64, actor Actor) error {
+	tx := db.NewTransaction()
+	order, err := LockLoadOrderByID(tx, orderID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load order: %v", err)
+	}
+	if order.Status != proto.OrderStatus_Transfer && order.Status != proto.OrderStatus_PayoutFailed {
+		tx.Rollback()
+		return fmt.Errorf("order have unexpected status '%v'", order.Status)
+	}
+
+	payout, err := LockLoadPayoutByOrder(tx, orderID)
+	switch {
+	// Orders confirmed before outbox was introduced
+	case err == gorm.ErrRecordNotFound:
+		err = createPayout(tx, order)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to create payout: %v", err)
+		}
+		payout, err = LockLoadPayoutByOrder(tx, orderID)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to load payout: %v", err)
+		}
+	case err != nil:
+		tx.Rollback()
+		return fmt.Errorf("failed to load payout: %v", err)
+	}
+	if payout.Status != proto.PayoutStatus_Pending && payout.Status != proto.PayoutStatus_Failed {
+		tx.Rollback()
+		return fmt.Errorf("payout have unexpected status '%v'", payout.Status)
+	}
+
+	payout.Status = proto.PayoutStatus_Pending
+	payout.NextAttemptAt = time.Now()
+	payout.Manual = order.Status == proto.OrderStatus_PayoutFailed
+	payout.Applied = false
+	err = tx.Save(&payout).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save payout: %v", err)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+
+	log.Info("payout of order %v retry requested by %v %v", orderID, actor.Kind, actor.Name)
+	kickPayouts()
+	return nil
+}
+
+// Stops automatic retries of order payout
+func giveUpPayout(orderID uint64, actor Actor) error {
+	tx := db.NewTransaction()
+	order, err := LockLoadOrderByID(tx, orderID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load order: %v", err)
+	}
+	if order.Status != proto.OrderStatus_Transfer {
+		tx.Rollback()
+		return fmt.Errorf("order have unexpected status '%v'", order.Status)
+	}
+	payout, err := LockLoadPayoutByOrder(tx, orderID)
+	if err != nil && err != gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return fmt.Errorf("failed to load payout: %v", err)
+	}
+	if payout.ID != 0 {
+		if payout.Status != proto.PayoutStatus_Pending {
+			tx.Rollback()
+			return fmt.Errorf("payout have unexpected status '%v'", payout.Status)
+		}
+		payout.Status = proto.PayoutStatus_Failed
+		payout.Message = "payout retries given up"
+		payout.Applied = true
+		err = tx.Save(&payout).Error
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to save payout: %v", err)
+		}
+	}
+
+	order.Status = proto.OrderStatus_PayoutFailed
+	err = order.Save(tx, actor, "payout retries given up")
+	if err != nil {
+		tx.Rollback()
+		return errors.New(proto.DBError)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+
+	payout.Destination = order.Destination
+	payout.Amount = order.PayoutAmount()
+	payout.OrderID = order.ID
+	notifyPayoutFailed(payout, "given up by "+actor.Name)
+	return nil
+}
+
+// Finishes order which was transferred by admin manually, pending transfer is canceled
+func finishPayoutManually(orderID uint64, actor Actor) error {
+	tx := db.NewTransaction()
+	order, err := LockLoadOrderByID(tx, orderID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load order: %v", err)
+	}
+	if order.Status != proto.OrderStatus_Transfer && order.Status != proto.OrderStatus_PayoutFailed {
+		tx.Rollback()
+		return fmt.Errorf("order have unexpected status '%v'", order.Status)
+	}
+	payout, err := LockLoadPayoutByOrder(tx, orderID)
+	if err != nil && err != gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return fmt.Errorf("failed to load payout: %v", err)
+	}
+	if payout.ID != 0 && payout.Status != proto.PayoutStatus_Sent {
+		payout.Status = proto.PayoutStatus_Canceled
+		payout.Message = "transferred manually"
+		payout.Applied = true
+		err = tx.Save(&payout).Error
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to save payout: %v", err)
+		}
+	}
+
+	order.Status = proto.OrderStatus_Finished
+	err = order.Save(tx, actor, "marked finished")
+	if err != nil {
+		tx.Rollback()
+		return errors.New(proto.DBError)
+	}
+	return tx.Commit().Error
+}
+
+func notifyPayoutFailed(payout Payout, reason string) {
+	go func() {
+		err := SendTelegramNotify(conf.TelegramChanel, fmt.Sprintf(
+			"Payout of order %v failed after %v attempts\naccount: %v\namount: %v\n%v",
+			payout.OrderID, payout.Attempts, payout.Destination, payout.Amount, reason,
+		), true)
+		if err != nil {
+			log.Errorf("failed to send payout failed notify: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"common/db"
+	"common/log"
+	"core/proto"
+	"errors"
+	"github.com/jinzhu/gorm"
+	"github.com/shopspring/decimal"
+)
+
+// Price of order is defined by the most specific pricing rule matching its currency, payment method
+// and fiat amount: rule with currency beats rule with payment method, which beats rule for any order.
+// Rule picks base rate from lb offers, lb amount is fiat amount divided by it. Bot fee is spread part of lb amount
+// plus fixed fee, but not less than min fee. Without matching rules minimal rate and BotFee from config are used.
+
+type PricingRule struct {
+	db.Model
+	// Empty matches any
+	Currency      string `gorm:"index"`
+	PaymentMethod string
+	// Band of fiat amount, zero max amount means no upper bound
+	MinAmount decimal.Decimal `gorm:"type:decimal"`
+	MaxAmount decimal.Decimal `gorm:"type:decimal"`
+
+	Base proto.PriceBase
+	// For percentile base, from 0 to 100
+	Percentile uint
+	// Part of lb amount
+	Spread decimal.Decimal `gorm:"type:decimal"`
+	// In BTC
+	FixedFee decimal.Decimal `gorm:"type:decimal"`
+	MinFee   decimal.Decimal `gorm:"type:decimal"`
+}
+
+func (rule PricingRule) matches(currency, method string, amount decimal.Decimal) bool {
+	return (rule.Currency == "" || rule.Currency == currency) &&
+		(rule.PaymentMethod == "" || rule.PaymentMethod == method) &&
+		amount.Cmp(rule.MinAmount) >= 0 &&
+		(rule.MaxAmount.Sign() == 0 || amount.Cmp(rule.MaxAmount) <= 0)
+}
+
+func (rule PricingRule) specificity() int {
+	ret := 0
+	if rule.Currency != "" {
+		ret += 2
+	}
+	if rule.PaymentMethod != "" {
+		ret++
+	}
+	return ret
+}
+
+func (rule PricingRule) BaseRate(node RateNode) decimal.Decimal {
+	switch rule.Base {
+	case proto.PriceBase_Median:
+		return node.Median
+	case proto.PriceBase_Percentile:
+		return node.Percentile(rule.Percentile)
+	}
+	return node.Minimal
+}
+
+func (rule PricingRule) BotFee(lbAmount decimal.Decimal) decimal.Decimal {
+	fee := lbAmount.Mul(rule.Spread).Add(rule.FixedFee)
+	if fee.Cmp(rule.MinFee) < 0 {
+		return rule.MinFee
+	}
+	return fee
+}
+
+// Rule used when nothing matches
+func defaultPricingRule() PricingRule {
+	return PricingRule{
+		Base:   proto.PriceBase_Minimal,
+		Spread: decimal.NewFromFloat(conf.BotFee),
+	}
+}
+
+// Returns the most specific rule for order parameters, the newest one wins among equal ones
+func SelectPricingRule(db *gorm.DB, currency, method string, amount decimal.Decimal) (PricingRule, error) {
+	var rules []PricingRule
+	err := db.Order("id DESC").Find(&rules, "currency = ? OR currency = ''", currency).Error
+	if err != nil {
+		return PricingRule{}, err
+	}
+	ret := defaultPricingRule()
+	best := -1
+	for _, rule := range rules {
+		if rule.matches(currency, method, amount) && rule.specificity() > best {
+			ret = rule
+			best = rule.specificity()
+		}
+	}
+	return ret, nil
+}
+
+type Price struct {
+	// Zero for default rule
+	RuleID   uint64
+	Rate     decimal.Decimal
+	LBAmount decimal.Decimal
+	BotFee   decimal.Decimal
+	// Rate snapshot price is based on
+	RateSnapshotID uint64
+	DerivedRate    bool
+}
+
+func priceWithRule(rule PricingRule, amount decimal.Decimal, node RateNode) (Price, error) {
+	rate := rule.BaseRate(node)
+	if rate.Sign() <= 0 {
+		return Price{}, errors.New("invalid base rate")
+	}
+	lbAmount := amount.Div(rate)
+	return Price{
+		RuleID:   rule.ID,
+		Rate:     rate,
+		LBAmount: lbAmount,
+		BotFee:   rule.BotFee(lbAmount),
+
+		RateSnapshotID: node.SnapshotID,
+		DerivedRate:    node.Derived,
+	}, nil
+}
+
+// Prices order with passed parameters, returns errors suitable for clients
+func PriceOrder(currency, method string, amount decimal.Decimal) (Price, error) {
+	rule, err := SelectPricingRule(db.New(), currency, method, amount)
+	if err != nil {
+		log.Errorf("failed to select pricing rule: %v", err)
+		return Price{}, errors.New(proto.DBError)
+	}
+	node, err := GetExchangeRate(currency)
+	if _, stale := err.(StaleRateError); stale {
+		log.Errorf("refused to price %v %v: %v", amount, currency, err)
+		return Price{}, errors.New(proto.StaleRateError)
+	}
+	if err != nil {
+		return Price{}, errors.New("failed to determine exchange rate")
+	}
+	price, err := priceWithRule(rule, amount, node)
+	if err != nil {
+		log.Errorf("failed to price %v %v with rule %v: %v", amount, currency, rule.ID, err)
+		return Price{}, errors.New("failed to determine exchange rate")
+	}
+	return price, nil
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/shopspring/decimal"
 	"lbapi"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -14,6 +15,11 @@ var (
 	DBError              = "db error"
 	ForbiddenError       = "forbidden"
 	ContactNotFoundError = "contact not found"
+	ContactMismatchError = "contact does not match order"
+	NoRequisitesError    = "empty requisites"
+	LackOfDepositError   = "lack of deposit"
+	OperatorBusyError    = "operator is busy"
+	StaleRateError       = "exchange rate is stale"
 )
 
 const DepositTransactionPrefix = "DEPO_"
@@ -59,6 +65,132 @@ type Operator struct {
 	Deposit      decimal.Decimal
 }
 
+type DepositEntryType int
+
+const (
+	// Deposit which operator had before ledger was introduced
+	DepositEntryType_Opening DepositEntryType = 1
+	// Incoming lb transaction with deposit prefix
+	DepositEntryType_Refill DepositEntryType = 2
+	// Write-off on order confirmation
+	DepositEntryType_Order DepositEntryType = 3
+	// Manual changes from admin
+	DepositEntryType_AdminRefill   DepositEntryType = 4
+	DepositEntryType_AdminWriteOff DepositEntryType = 5
+	// Approved withdrawal sent to operator
+	DepositEntryType_Withdrawal DepositEntryType = 6
+)
+
+var DepositEntryTypeStrings = map[DepositEntryType]string{
+	DepositEntryType_Opening:       "opening",
+	DepositEntryType_Refill:        "refill",
+	DepositEntryType_Order:         "order",
+	DepositEntryType_AdminRefill:   "admin refill",
+	DepositEntryType_AdminWriteOff: "admin write-off",
+	DepositEntryType_Withdrawal:    "withdrawal",
+}
+
+func (t DepositEntryType) String() string {
+	str, ok := DepositEntryTypeStrings[t]
+	if ok {
+		return str
+	}
+	return strconv.FormatInt(int64(t), 10)
+}
+
+type DepositEntry struct {
+	ID         uint64
+	OperatorID uint64
+	Type       DepositEntryType
+	// Negative for write-offs
+	Amount decimal.Decimal
+	// Deposit after entry was applied
+	Balance         decimal.Decimal
+	LBTransactionID uint64
+	OrderID         uint64
+	WithdrawalID    uint64
+	Admin           string
+	Comment         string
+	CreatedAt       time.Time
+}
+
+var GetDepositLedger = rabbit.RPC{
+	Name:        "get_deposit_ledger",
+	Concurrent:  true,
+	HandlerType: (func(operatorID uint64) ([]DepositEntry, error))(nil),
+}
+
+// Fee tier of operator and conditions of the next one
+type FeeTierStatus struct {
+	Tier string
+	// Part of lb amount which operator earns
+	Fee decimal.Decimal
+	// Tier is assigned by admin and is not changed automatically
+	Manual bool
+	// Completed lb volume of last 30 days
+	MonthlyVolume decimal.Decimal
+	// Empty if there is no better tier or tier is manual
+	NextTier       string
+	NextFee        decimal.Decimal
+	NextVolume     decimal.Decimal
+	NextTenureDays uint
+}
+
+var GetFeeTierStatus = rabbit.RPC{
+	Name:        "get_fee_tier_status",
+	Concurrent:  true,
+	HandlerType: (func(operatorID uint64) (FeeTierStatus, error))(nil),
+}
+
+type WithdrawalStatus int
+
+const (
+	// Waiting for approve from admin
+	WithdrawalStatus_Pending  WithdrawalStatus = 1
+	WithdrawalStatus_Sent     WithdrawalStatus = 2
+	WithdrawalStatus_Rejected WithdrawalStatus = 3
+	// Approved and being sent from buffer. Withdrawal stays here if result of send is unknown
+	// until admin checks wallet and marks it sent or returns it to pending.
+	WithdrawalStatus_Sending WithdrawalStatus = 4
+)
+
+var WithdrawalStatusStrings = map[WithdrawalStatus]string{
+	WithdrawalStatus_Pending:  "pending",
+	WithdrawalStatus_Sent:     "sent",
+	WithdrawalStatus_Rejected: "rejected",
+	WithdrawalStatus_Sending:  "sending",
+}
+
+func (s WithdrawalStatus) String() string {
+	str, ok := WithdrawalStatusStrings[s]
+	if ok {
+		return str
+	}
+	return strconv.FormatInt(int64(s), 10)
+}
+
+type Withdrawal struct {
+	ID         uint64
+	OperatorID uint64
+	Amount     decimal.Decimal
+	// Bitcoin address
+	Address   string
+	Status    WithdrawalStatus
+	CreatedAt time.Time
+}
+
+type RequestWithdrawalRequest struct {
+	OperatorID uint64
+	Amount     decimal.Decimal
+	Address    string
+}
+
+var RequestWithdrawal = rabbit.RPC{
+	Name:        "request_withdrawal",
+	Concurrent:  true,
+	HandlerType: (func(RequestWithdrawalRequest) (Withdrawal, error))(nil),
+}
+
 var CheckKey = rabbit.RPC{
 	Name:        "check_lb_key",
 	Concurrent:  true,
@@ -121,7 +253,7 @@ const (
 	OrderStatus_Linked OrderStatus = 6
 	// Waiting for payment from client
 	OrderStatus_Payment OrderStatus = 7
-	// Canceled by client
+	// Canceled by client or by cancel of related lb contact
 	OrderStatus_Canceled OrderStatus = 8
 	// Client did not fund lb contract in time
 	OrderStatus_Timeout OrderStatus = 9
@@ -135,6 +267,10 @@ const (
 	OrderStatus_ConfirmationExtended OrderStatus = 13
 	// Payment was not confirmed in time and operator dropped order
 	OrderStatus_Unconfirmed OrderStatus = 14
+	// Bitshares transfer failed too many times or admin gave up on it
+	OrderStatus_PayoutFailed OrderStatus = 15
+	// Client or operator disagree about payment, waiting for admin verdict
+	OrderStatus_Disputed OrderStatus = 16
 )
 
 var OrderStatusStrings = map[OrderStatus]string{
@@ -152,6 +288,8 @@ var OrderStatusStrings = map[OrderStatus]string{
 	OrderStatus_Finished:             "finished",
 	OrderStatus_ConfirmationExtended: "extended",
 	OrderStatus_Unconfirmed:          "unconfirmed",
+	OrderStatus_PayoutFailed:         "payout failed",
+	OrderStatus_Disputed:             "disputed",
 }
 
 func (s OrderStatus) String() string {
@@ -178,9 +316,33 @@ type Order struct {
 	LBFee       decimal.Decimal
 	OperatorFee decimal.Decimal
 	BotFee      decimal.Decimal
+	// Operator fee and deposit write-off of settled part, less than full ones after split verdict
+	SettledOperatorFee decimal.Decimal
+	WriteOffAmount     decimal.Decimal
 
 	Status     OrderStatus
 	OperatorID uint64
+	// Zero unless related lb contact was disputed
+	LBDisputedAt time.Time
+	// Optional quote which fees should be kept on order
+	QuoteID uint64
+	// Rate is derived from other currency through cross rate
+	DerivedRate bool
+	// Client or lb if related contact was canceled, zero unless order is canceled
+	CanceledBy ActorKind
+	// Zero unless order was disputed
+	DisputedAt     time.Time
+	DisputedBy     ActorKind
+	DisputeReason  string
+	DisputeVerdict DisputeVerdict
+	// Written verdict of admin
+	DisputeComment string
+	// Deadlines of order stages according to configured timeouts, zero if stage was not reached
+	AcceptBy  time.Time
+	PayBy     time.Time
+	ConfirmBy time.Time
+	// Sequence number of event among events of this order, zero if order is not sent as event
+	EventSeq uint64
 }
 
 var OrderEventRoute = rabbit.Route{
@@ -201,6 +363,299 @@ var OrderEventRoute = rabbit.Route{
 	},
 }
 
+// Which price of lb offers is taken as base rate
+type PriceBase int
+
+const (
+	PriceBase_Minimal    PriceBase = 0
+	PriceBase_Median     PriceBase = 1
+	PriceBase_Percentile PriceBase = 2
+)
+
+var PriceBaseStrings = map[PriceBase]string{
+	PriceBase_Minimal:    "minimal",
+	PriceBase_Median:     "median",
+	PriceBase_Percentile: "percentile",
+}
+
+func (b PriceBase) String() string {
+	str, ok := PriceBaseStrings[b]
+	if ok {
+		return str
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+type OrderWarningKind int
+
+const (
+	OrderWarning_Accept       OrderWarningKind = 1
+	OrderWarning_Payment      OrderWarningKind = 2
+	OrderWarning_Confirmation OrderWarningKind = 3
+)
+
+var OrderWarningKindStrings = map[OrderWarningKind]string{
+	OrderWarning_Accept:       "accept",
+	OrderWarning_Payment:      "payment",
+	OrderWarning_Confirmation: "confirmation",
+}
+
+func (k OrderWarningKind) String() string {
+	str, ok := OrderWarningKindStrings[k]
+	if ok {
+		return str
+	}
+	return strconv.FormatInt(int64(k), 10)
+}
+
+// Sent to client some time before deadline of current order stage
+type OrderWarning struct {
+	// Sequence number of event among events of order
+	Seq         uint64
+	OrderID     uint64
+	Destination string
+	Kind        OrderWarningKind
+	Deadline    time.Time
+	// Like "5 minutes left to pay"
+	Message string
+}
+
+var OrderWarningRoute = rabbit.Route{
+	{
+		Node: rabbit.Exchange{
+			Name:    "order_warning",
+			Kind:    "fanout",
+			Durable: true,
+		},
+	},
+	{
+		Keys: []string{""},
+		Node: rabbit.Queue{
+			Name:       "",
+			Exclusive:  true,
+			AutoDelete: true,
+		},
+	},
+}
+
+// Exchange rate of currency, published as rate_event once it changes noticeably
+type Rate struct {
+	Currency string
+	// Fiat paid per bitcoin
+	Minimal   decimal.Decimal
+	Median    decimal.Decimal
+	Ads       int
+	Source    string
+	Derived   bool
+	CheckedAt time.Time
+}
+
+var RateEventRoute = rabbit.Route{
+	{
+		Node: rabbit.Exchange{
+			Name: "rate_event",
+			Kind: "fanout",
+		},
+	},
+	{
+		Keys: []string{""},
+		Node: rabbit.Queue{
+			Name:       "",
+			Exclusive:  true,
+			AutoDelete: true,
+		},
+	},
+}
+
+// Returns rates of every known currency if currency is empty
+var GetRates = rabbit.RPC{
+	Name:        "get_rates",
+	Concurrent:  true,
+	HandlerType: (func(currency string) ([]Rate, error))(nil),
+}
+
+// Remembers last handled sequence number of recent orders. Core numbers events of every order
+// in order of commit, but they can be published twice or out of order, so subscribers use it
+// to drop events which are not newer than the last handled one of the same order.
+type EventSequencer struct {
+	mutex sync.Mutex
+	size  int
+	last  map[uint64]uint64
+	// Remembered orders in order of arrival
+	queue []uint64
+}
+
+func NewEventSequencer(size int) *EventSequencer {
+	return &EventSequencer{
+		size: size,
+		last: map[uint64]uint64{},
+	}
+}
+
+// Returns true if event of order with such sequence number is duplicate or older than handled one
+func (s *EventSequencer) Stale(orderID, seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	last, ok := s.last[orderID]
+	if ok && seq <= last {
+		return true
+	}
+	if !ok {
+		s.queue = append(s.queue, orderID)
+		if len(s.queue) > s.size {
+			delete(s.last, s.queue[0])
+			s.queue = s.queue[1:]
+		}
+	}
+	s.last[orderID] = seq
+	return false
+}
+
+// Who caused order status change
+type ActorKind int
+
+const (
+	ActorKind_None     ActorKind = 0
+	ActorKind_Operator ActorKind = 1
+	ActorKind_Client   ActorKind = 2
+	ActorKind_Admin    ActorKind = 3
+	// Order timeouts from order manager
+	ActorKind_Timeout ActorKind = 4
+	// Changes of related lb contact
+	ActorKind_LB ActorKind = 5
+	// Background workers of core
+	ActorKind_System ActorKind = 6
+)
+
+var ActorKindStrings = map[ActorKind]string{
+	ActorKind_None:     "none",
+	ActorKind_Operator: "operator",
+	ActorKind_Client:   "client",
+	ActorKind_Admin:    "admin",
+	ActorKind_Timeout:  "timeout",
+	ActorKind_LB:       "lb",
+	ActorKind_System:   "system",
+}
+
+func (k ActorKind) String() string {
+	str, ok := ActorKindStrings[k]
+	if ok {
+		return str
+	}
+	return strconv.FormatInt(int64(k), 10)
+}
+
+type OrderHistoryRecord struct {
+	OrderID   uint64
+	OldStatus OrderStatus
+	NewStatus OrderStatus
+	ActorKind ActorKind
+	// Operator id, client address or admin name depending on kind
+	Actor     string
+	Reason    string
+	CreatedAt time.Time
+}
+
+var GetOrderHistory = rabbit.RPC{
+	Name:        "get_order_history",
+	Concurrent:  true,
+	HandlerType: (func(orderID uint64) ([]OrderHistoryRecord, error))(nil),
+}
+
+type QuoteRequest struct {
+	Currency      string
+	FiatAmount    decimal.Decimal
+	PaymentMethod string
+}
+
+// Expected values of order, all amounts are in BTC
+type Quote struct {
+	ID            uint64
+	Currency      string
+	FiatAmount    decimal.Decimal
+	PaymentMethod string
+	LBAmount      decimal.Decimal
+	// Estimated
+	LBFee decimal.Decimal
+	// Upper bound, order is charged fee of accepting operator tier capped by it
+	OperatorFee decimal.Decimal
+	BotFee      decimal.Decimal
+	// Order gives at least this much unless lb fee differs from estimated one
+	OutletAmount decimal.Decimal
+	// Rate is derived from other currency through cross rate
+	DerivedRate bool
+	ExpiresAt   time.Time
+}
+
+var GetQuote = rabbit.RPC{
+	Name:        "get_quote",
+	Concurrent:  true,
+	HandlerType: (func(QuoteRequest) (Quote, error))(nil),
+	Timeout:     time.Second * 20,
+}
+
+// Errors returned by CreateOrder when order violates limits.
+// They are expected to be passed to client as is
+var (
+	MethodNotAllowedError    = "payment method is not allowed"
+	AmountBelowMinimumError  = "amount is below minimum"
+	AmountAboveMaximumError  = "amount is above maximum"
+	DailyLimitExceededError  = "daily limit exceeded"
+	WeeklyLimitExceededError = "weekly limit exceeded"
+)
+
+var LimitErrors = []string{
+	MethodNotAllowedError,
+	AmountBelowMinimumError,
+	AmountAboveMaximumError,
+	DailyLimitExceededError,
+	WeeklyLimitExceededError,
+}
+
+func IsLimitError(err error) bool {
+	for _, str := range LimitErrors {
+		if err.Error() == str {
+			return true
+		}
+	}
+	return false
+}
+
+// Limits of orders for currency and payment method.
+// Zero amounts mean absence of limit.
+type OrderLimit struct {
+	Currency string
+	// Empty for rule which applies to every method of currency
+	PaymentMethod string
+	MinAmount     decimal.Decimal
+	MaxAmount     decimal.Decimal
+	// Fiat volume per client address
+	DailyLimit  decimal.Decimal
+	WeeklyLimit decimal.Decimal
+}
+
+var GetOrderLimits = rabbit.RPC{
+	Name:        "get_order_limits",
+	Concurrent:  true,
+	HandlerType: (func(currency string) ([]OrderLimit, error))(nil),
+}
+
+type PaymentMethod struct {
+	Code string
+	Name string
+	// Empty list means method is available for any currency
+	Currencies []string
+}
+
+var ListPaymentMethods = rabbit.RPC{
+	Name:        "list_payment_methods",
+	Concurrent:  true,
+	HandlerType: (func(currency string) ([]PaymentMethod, error))(nil),
+}
+
 var CreateOrder = rabbit.RPC{
 	Name:        "create_order",
 	Concurrent:  true,
@@ -255,15 +710,27 @@ var DropOrder = rabbit.RPC{
 	HandlerType: (func(DropOrderRequest) (bool, error))(nil),
 }
 
+// Order is linked either to contact passed explicitly or to the best matching active contact of operator.
+// Requisites can be passed later by request without contact for already linked order.
 type LinkLBContractRequest struct {
-	OrderID    uint64
+	OrderID uint64
+	// Can be empty if requisites were passed with previous ambiguous request or will be passed separately
 	Requisites string
+	// Contact passed by operator or chosen from candidates of previous request
+	ContactID uint64
+}
+
+type LinkLBContractResponse struct {
+	Order Order
+	// Set if several contacts match order equally well, order is not linked then
+	// and operator should choose one of them
+	Candidates []uint64
 }
 
 var LinkLBContact = rabbit.RPC{
 	Name:        "link_lb_contact",
 	Concurrent:  true,
-	HandlerType: (func(LinkLBContractRequest) (Order, error))(nil),
+	HandlerType: (func(LinkLBContractRequest) (LinkLBContractResponse, error))(nil),
 	Timeout:     time.Second * 10,
 }
 
@@ -279,6 +746,46 @@ var MarkPayed = rabbit.RPC{
 	HandlerType: (func(orderID uint64) (bool, error))(nil),
 }
 
+type DisputeVerdict int
+
+const (
+	DisputeVerdict_None DisputeVerdict = 0
+	// Order is finished as confirmed
+	DisputeVerdict_PayClient DisputeVerdict = 1
+	// Order is closed without payout, deposit is untouched
+	DisputeVerdict_ReturnToOperator DisputeVerdict = 2
+	// Part of payout is transferred to client and written-off from deposit
+	DisputeVerdict_Split DisputeVerdict = 3
+)
+
+var DisputeVerdictStrings = map[DisputeVerdict]string{
+	DisputeVerdict_None:             "none",
+	DisputeVerdict_PayClient:        "pay client",
+	DisputeVerdict_ReturnToOperator: "return to operator",
+	DisputeVerdict_Split:            "split",
+}
+
+func (v DisputeVerdict) String() string {
+	str, ok := DisputeVerdictStrings[v]
+	if ok {
+		return str
+	}
+	return strconv.FormatInt(int64(v), 10)
+}
+
+type OpenDisputeRequest struct {
+	OrderID uint64
+	// Zero if dispute is opened by client
+	OperatorID uint64
+	Reason     string
+}
+
+var OpenDispute = rabbit.RPC{
+	Name:        "open_dispute",
+	Concurrent:  true,
+	HandlerType: (func(OpenDisputeRequest) (Order, error))(nil),
+}
+
 var ConfirmPayment = rabbit.RPC{
 	Name:        "confirm_payment",
 	Concurrent:  true,
@@ -287,13 +794,47 @@ var ConfirmPayment = rabbit.RPC{
 }
 
 type BitsharesPaymentRequest struct {
-	Name   string
-	Amount decimal.Decimal
+	// Unique id of payout. Payer must not make second transfer with the same id,
+	// it should respond with AlreadySent instead.
+	PayoutID string
+	Name     string
+	Amount   decimal.Decimal
 }
 
 type BitsharesPaymentResponse struct {
 	Success bool
-	Message string
+	// Transfer with such payout id was made before
+	AlreadySent bool
+	// Transfer with such payout id was started, but its result is unknown
+	Uncertain bool
+	Message   string
+}
+
+type PayoutStatus int
+
+const (
+	// Waiting for transfer or its retry
+	PayoutStatus_Pending PayoutStatus = 1
+	PayoutStatus_Sent    PayoutStatus = 2
+	// Retries are exhausted or given up by admin
+	PayoutStatus_Failed PayoutStatus = 3
+	// Order was finished by admin manually
+	PayoutStatus_Canceled PayoutStatus = 4
+)
+
+var PayoutStatusStrings = map[PayoutStatus]string{
+	PayoutStatus_Pending:  "pending",
+	PayoutStatus_Sent:     "sent",
+	PayoutStatus_Failed:   "failed",
+	PayoutStatus_Canceled: "canceled",
+}
+
+func (s PayoutStatus) String() string {
+	str, ok := PayoutStatusStrings[s]
+	if ok {
+		return str
+	}
+	return strconv.FormatInt(int64(s), 10)
 }
 
 var BitsharesPayment = rabbit.RPC{
@@ -302,3 +843,25 @@ var BitsharesPayment = rabbit.RPC{
 	HandlerType: (func(BitsharesPaymentRequest) (BitsharesPaymentResponse, error))(nil),
 	Timeout:     time.Second * 30,
 }
+
+// Errors returned by CreateOrder for bad destination account
+var (
+	InvalidDestinationError = "invalid destination"
+	UnknownDestinationError = "unknown destination"
+)
+
+type ValidateDestinationResponse struct {
+	// Whether account with such name exists
+	Exists bool
+	// Payer could not reach bitshares nodes, so account was not checked
+	Unavailable bool
+	Message     string
+}
+
+// Answered by payer, checks that bitshares account exists
+var ValidateDestination = rabbit.RPC{
+	Name:        "bitshares_validate_destination",
+	Concurrent:  true,
+	HandlerType: (func(name string) (ValidateDestinationResponse, error))(nil),
+	Timeout:     time.Second * 10,
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/jinzhu/gorm"
 	"github.com/qor/admin"
 	"github.com/qor/qor"
+	qorres "github.com/qor/qor/resource"
 	"github.com/qor/roles"
 	"github.com/qor/validations"
 	"github.com/shopspring/decimal"
@@ -77,6 +78,54 @@ var resources = []*resource{
 		},
 		init: lbTransactionsInit,
 	},
+	{
+		value: &DepositEntry{},
+		config: &admin.Config{
+			Name: "DepositEntry",
+			Permission: roles.Deny(roles.Delete, roles.Anyone).
+				Deny(roles.Create, roles.Anyone).Deny(roles.Update, roles.Anyone),
+		},
+		init: depositEntriesInit,
+	},
+	{
+		value: &Withdrawal{},
+		config: &admin.Config{
+			Name: "Withdrawal",
+			Permission: roles.Deny(roles.Delete, roles.Anyone).
+				Deny(roles.Create, roles.Anyone).Deny(roles.Update, roles.Anyone),
+		},
+		init: withdrawalsInit,
+	},
+	{
+		value: &OrderLimit{},
+		config: &admin.Config{
+			Name: "OrderLimit",
+		},
+		init: orderLimitsInit,
+	},
+	{
+		value: &FeeTier{},
+		config: &admin.Config{
+			Name: "FeeTier",
+		},
+		init: feeTiersInit,
+	},
+	{
+		value: &PricingRule{},
+		config: &admin.Config{
+			Name: "PricingRule",
+		},
+		init: pricingRulesInit,
+	},
+	{
+		value: &RateSnapshot{},
+		config: &admin.Config{
+			Name: "RateSnapshot",
+			Permission: roles.Deny(roles.Delete, roles.Anyone).
+				Deny(roles.Create, roles.Anyone).Deny(roles.Update, roles.Anyone),
+		},
+		init: rateSnapshotsInit,
+	},
 }
 
 func lbTransactionsInit(res *admin.Resource) {
@@ -100,20 +149,56 @@ func operatorsInit(res *admin.Resource) {
 	res.IndexAttrs(
 		"ID", "Username", "Deposit", "Status", "CurrentOrder",
 	)
+	res.Meta(&admin.Meta{
+		Name: "Ledger",
+		Type: "ledger",
+		Valuer: func(val interface{}, ctx *qor.Context) interface{} {
+			op, ok := val.(*Operator)
+			if !ok {
+				return nil
+			}
+			ledger, err := LoadDepositLedger(ctx.DB, op.ID)
+			if err != nil {
+				log.Errorf("failed to load deposit ledger of operator %v: %v", op.ID, err)
+				return nil
+			}
+			return ledger
+		},
+	})
 	res.ShowAttrs("-Public", "-Secret")
-	res.EditAttrs("Note")
+	res.EditAttrs("Note", "FeeTierID", "FeeTierManual")
 
 	res.Meta(&admin.Meta{
 		Name: "Note",
 		Type: "text",
 	})
-	// Make sure nothing but note can be saved(to avoid possible races)
+	res.Meta(&admin.Meta{
+		Name: "FeeTierID",
+		Type: "select_one",
+		Collection: func(_ interface{}, ctx *qor.Context) [][]string {
+			ret := [][]string{{"0", defaultFeeTierName}}
+			tiers, err := LoadFeeTiers(ctx.DB)
+			if err != nil {
+				log.Errorf("failed to load fee tiers: %v", err)
+				return ret
+			}
+			for _, tier := range tiers {
+				ret = append(ret, []string{fmt.Sprint(tier.ID), tier.Name})
+			}
+			return ret
+		},
+	})
+	// Make sure nothing but note and fee tier can be saved(to avoid possible races)
 	res.SaveHandler = func(val interface{}, ctx *qor.Context) error {
 		op, ok := val.(*Operator)
 		if !ok {
 			return errors.New("unxepected record type")
 		}
-		return db.New().Model(op).Update("note", op.Note).Error
+		return db.New().Model(op).Updates(map[string]interface{}{
+			"note":            op.Note,
+			"fee_tier_id":     op.FeeTierID,
+			"fee_tier_manual": op.FeeTierManual,
+		}).Error
 	}
 
 	statuses := make([]int, 0, len(proto.OperatorStatusStrings))
@@ -138,13 +223,15 @@ func operatorsInit(res *admin.Resource) {
 	}
 	depoArgRes := res.GetAdmin().NewResource(&depoArg{})
 
-	updateDepo := func(records []interface{}, arg *depoArg, writeOff bool) error {
+	updateDepo := func(records []interface{}, arg *depoArg, writeOff bool, actor Actor) error {
 		if arg.Amount.Sign() <= 0 || arg.Comment == "" {
 			return errors.New("invalid argument")
 		}
 
+		entryType := proto.DepositEntryType_AdminRefill
 		if writeOff {
 			arg.Amount = arg.Amount.Neg()
+			entryType = proto.DepositEntryType_AdminWriteOff
 		}
 		tx := db.NewTransaction()
 		for _, record := range records {
@@ -153,7 +240,12 @@ func operatorsInit(res *admin.Resource) {
 				tx.Rollback()
 				return errors.New("unxepected record type")
 			}
-			err := op.ChangeDeposit(tx, arg.Amount)
+			_, err := op.ChangeDeposit(tx, DepositEntry{
+				Type:    entryType,
+				Amount:  arg.Amount,
+				Admin:   actor.Name,
+				Comment: arg.Comment,
+			})
 			if err != nil {
 				tx.Rollback()
 				return err
@@ -179,7 +271,7 @@ func operatorsInit(res *admin.Resource) {
 			if !ok {
 				return errors.New("unxepected argument type")
 			}
-			return updateDepo(argument.FindSelectedRecords(), arg, false)
+			return updateDepo(argument.FindSelectedRecords(), arg, false, AdminActor(argument.Context.CurrentUser))
 		},
 	})
 	res.Action(&admin.Action{
@@ -191,7 +283,374 @@ func operatorsInit(res *admin.Resource) {
 			if !ok {
 				return errors.New("unxepected argument type")
 			}
-			return updateDepo(argument.FindSelectedRecords(), arg, true)
+			return updateDepo(argument.FindSelectedRecords(), arg, true, AdminActor(argument.Context.CurrentUser))
+		},
+	})
+	res.Action(&admin.Action{
+		Name:  "Recompute deposit",
+		Modes: []string{"show", "menu_item"},
+		Handler: func(argument *admin.ActionArgument) error {
+			tx := db.NewTransaction()
+			for _, record := range argument.FindSelectedRecords() {
+				record, ok := record.(*Operator)
+				if !ok {
+					tx.Rollback()
+					return errors.New("unxepected record type")
+				}
+				op, err := LockLoadOperatorByID(tx, record.ID)
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+				deposit, err := RecomputeDeposit(tx, op.ID)
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+				msg := fmt.Sprintf("Deposit of operator %v(%v) matches ledger: %v", op.ID, op.Username, deposit)
+				if !deposit.Equal(op.Deposit) {
+					msg = fmt.Sprintf("Deposit of operator %v(%v) was recomputed from ledger: %v -> %v", op.ID, op.Username, op.Deposit, deposit)
+					log.Warn(msg)
+				}
+				argument.Context.Flash(msg, "info")
+			}
+			return tx.Commit().Error
+		},
+	})
+}
+
+func depositEntriesInit(res *admin.Resource) {
+	res.SearchAttrs(
+		"Comment", "Admin",
+	)
+	res.IndexAttrs(
+		"ID", "CreatedAt", "OperatorID", "Type", "Amount", "Balance", "OrderID", "LBTransactionID", "Comment",
+	)
+
+	types := make([]int, 0, len(proto.DepositEntryTypeStrings))
+	for entryType := range proto.DepositEntryTypeStrings {
+		types = append(types, int(entryType))
+	}
+	sort.Ints(types)
+	for _, entryType := range types {
+		scp := entryType
+		res.Scope(&admin.Scope{
+			Name:  proto.DepositEntryType(scp).String(),
+			Group: "Type",
+			Handler: func(db *gorm.DB, context *qor.Context) *gorm.DB {
+				return db.Where("type = ?", scp)
+			},
+		})
+	}
+}
+
+func withdrawalsInit(res *admin.Resource) {
+	res.IndexAttrs(
+		"ID", "CreatedAt", "OperatorID", "Amount", "Address", "Status", "Admin", "SentAt", "Message",
+	)
+
+	statuses := make([]int, 0, len(proto.WithdrawalStatusStrings))
+	for status := range proto.WithdrawalStatusStrings {
+		statuses = append(statuses, int(status))
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		scp := status
+		res.Scope(&admin.Scope{
+			Name:  proto.WithdrawalStatus(scp).String(),
+			Group: "Status",
+			Handler: func(db *gorm.DB, context *qor.Context) *gorm.DB {
+				return db.Where("status = ?", scp)
+			},
+		})
+	}
+
+	statusVisible := func(status proto.WithdrawalStatus) func(interface{}, *admin.Context) bool {
+		return func(record interface{}, context *admin.Context) bool {
+			w, ok := record.(*Withdrawal)
+			if !ok {
+				log.Errorf("unexpected type %v in visible check of withdrawal qor action", reflect.TypeOf(record))
+				return false
+			}
+			return w.Status == status
+		}
+	}
+	pendingVisible := statusVisible(proto.WithdrawalStatus_Pending)
+
+	handle := func(arg *admin.ActionArgument, handler func(uint64, Actor) error) error {
+		for _, record := range arg.FindSelectedRecords() {
+			w, ok := record.(*Withdrawal)
+			if !ok {
+				return fmt.Errorf("unexpected type %v in withdrawal qor action", reflect.TypeOf(record))
+			}
+			err := handler(w.ID, AdminActor(arg.Context.CurrentUser))
+			if err != nil {
+				return fmt.Errorf("withdrawal %v: %v", w.ID, err)
+			}
+		}
+		return nil
+	}
+
+	res.Action(&admin.Action{
+		Name:       "Approve",
+		Modes:      []string{"show", "menu_item"},
+		Permission: roles.Allow(roles.Update, roles.Anyone),
+		Handler: func(arg *admin.ActionArgument) error {
+			return handle(arg, approveWithdrawal)
+		},
+		Visible: pendingVisible,
+	})
+	res.Action(&admin.Action{
+		Name:       "Reject",
+		Modes:      []string{"show", "menu_item"},
+		Permission: roles.Allow(roles.Update, roles.Anyone),
+		Handler: func(arg *admin.ActionArgument) error {
+			return handle(arg, rejectWithdrawal)
+		},
+		Visible: pendingVisible,
+	})
+	// For withdrawals stuck in sending, admin should check lb wallet first
+	res.Action(&admin.Action{
+		Name:       "Mark sent",
+		Modes:      []string{"show", "menu_item"},
+		Permission: roles.Allow(roles.Update, roles.Anyone),
+		Handler: func(arg *admin.ActionArgument) error {
+			return handle(arg, finishWithdrawal)
+		},
+		Visible: statusVisible(proto.WithdrawalStatus_Sending),
+	})
+	res.Action(&admin.Action{
+		Name:       "Mark not sent",
+		Modes:      []string{"show", "menu_item"},
+		Permission: roles.Allow(roles.Update, roles.Anyone),
+		Handler: func(arg *admin.ActionArgument) error {
+			return handle(arg, returnWithdrawal)
+		},
+		Visible: statusVisible(proto.WithdrawalStatus_Sending),
+	})
+}
+
+func orderLimitsInit(res *admin.Resource) {
+	res.SearchAttrs(
+		"Currency", "PaymentMethod",
+	)
+	res.IndexAttrs(
+		"ID", "Currency", "PaymentMethod", "MinAmount", "MaxAmount", "DailyLimit", "WeeklyLimit",
+	)
+	res.EditAttrs(
+		"Currency", "PaymentMethod", "MinAmount", "MaxAmount", "DailyLimit", "WeeklyLimit",
+	)
+	res.NewAttrs(res.EditAttrs())
+
+	res.AddValidator(&qorres.Validator{
+		Name: "order_limit",
+		Handler: func(record interface{}, metaValues *qorres.MetaValues, context *qor.Context) error {
+			limit, ok := record.(*OrderLimit)
+			if !ok {
+				return errors.New("unxepected record type")
+			}
+			if !IsKnownCurrency(limit.Currency) {
+				return validations.NewError(record, "Currency", "unknown currency")
+			}
+			if limit.MaxAmount.Sign() > 0 && limit.MinAmount.Cmp(limit.MaxAmount) > 0 {
+				return validations.NewError(record, "MaxAmount", "maximum is less than minimum")
+			}
+			return nil
+		},
+	})
+}
+
+func feeTiersInit(res *admin.Resource) {
+	res.IndexAttrs(
+		"ID", "Name", "Fee", "MinMonthlyVolume", "MinTenureDays",
+	)
+	res.EditAttrs(
+		"Name", "Fee", "MinMonthlyVolume", "MinTenureDays",
+	)
+	res.NewAttrs(res.EditAttrs())
+
+	res.AddValidator(&qorres.Validator{
+		Name: "fee_tier",
+		Handler: func(record interface{}, metaValues *qorres.MetaValues, context *qor.Context) error {
+			tier, ok := record.(*FeeTier)
+			if !ok {
+				return errors.New("unxepected record type")
+			}
+			if tier.Name == "" || tier.Name == defaultFeeTierName {
+				return validations.NewError(record, "Name", "invalid name")
+			}
+			if tier.Fee.Sign() < 0 || tier.Fee.Cmp(decimal.New(1, 0)) >= 0 {
+				return validations.NewError(record, "Fee", "fee should be part of amount, from 0 to 1")
+			}
+			return nil
+		},
+	})
+}
+
+// Sample order priced by rule
+type pricePreview struct {
+	FiatAmount  decimal.Decimal
+	Rate        decimal.Decimal
+	LBAmount    decimal.Decimal
+	LBFee       decimal.Decimal
+	OperatorFee decimal.Decimal
+	BotFee      decimal.Decimal
+	// What client gets and fiat paid per bitcoin
+	Outlet      decimal.Decimal
+	ClientPrice decimal.Decimal
+}
+
+func pricingRulesInit(res *admin.Resource) {
+	res.SearchAttrs(
+		"Currency", "PaymentMethod",
+	)
+	res.IndexAttrs(
+		"ID", "Currency", "PaymentMethod", "MinAmount", "MaxAmount", "Base", "Spread", "FixedFee", "MinFee",
+	)
+	res.EditAttrs(
+		"Currency", "PaymentMethod", "MinAmount", "MaxAmount", "Base", "Percentile", "Spread", "FixedFee", "MinFee",
+	)
+	res.NewAttrs(res.EditAttrs())
+	res.ShowAttrs(&admin.Section{
+		Rows: [][]string{
+			{"Currency", "PaymentMethod"},
+			{"MinAmount", "MaxAmount"},
+			{"Base", "Percentile"},
+			{"Spread", "FixedFee", "MinFee"},
+		},
+	}, &admin.Section{
+		Title: "Preview",
+		Rows: [][]string{
+			{"Preview"},
+		},
+	})
+
+	bases := make([]int, 0, len(proto.PriceBaseStrings))
+	for base := range proto.PriceBaseStrings {
+		bases = append(bases, int(base))
+	}
+	sort.Ints(bases)
+	res.Meta(&admin.Meta{
+		Name: "Base",
+		Type: "select_one",
+		Collection: func(_ interface{}, _ *qor.Context) [][]string {
+			ret := [][]string{}
+			for _, base := range bases {
+				ret = append(ret, []string{fmt.Sprint(base), proto.PriceBase(base).String()})
+			}
+			return ret
+		},
+	})
+	res.Meta(&admin.Meta{
+		Name: "Preview",
+		Type: "pricing_preview",
+		Valuer: func(val interface{}, ctx *qor.Context) interface{} {
+			rule, ok := val.(*PricingRule)
+			if !ok || rule.Currency == "" {
+				return nil
+			}
+			node, err := GetExchangeRate(rule.Currency)
+			if err != nil {
+				log.Errorf("failed to get %v rate for pricing preview: %v", rule.Currency, err)
+				return nil
+			}
+			// Bounds and middle of amount band
+			amounts := []decimal.Decimal{rule.MinAmount}
+			if rule.MaxAmount.Sign() > 0 {
+				amounts = append(amounts, rule.MinAmount.Add(rule.MaxAmount).Div(decimal.New(2, 0)), rule.MaxAmount)
+			}
+			// Fee of accepting operator is unknown, preview shows what client is quoted
+			fee, err := maxOperatorFeeRate(db.New())
+			if err != nil {
+				log.Errorf("failed to load fee tiers for pricing preview: %v", err)
+				return nil
+			}
+			var ret []pricePreview
+			for _, amount := range amounts {
+				if amount.Sign() <= 0 {
+					continue
+				}
+				price, err := priceWithRule(*rule, amount, node)
+				if err != nil {
+					return nil
+				}
+				p := pricePreview{
+					FiatAmount:  amount,
+					Rate:        price.Rate,
+					LBAmount:    price.LBAmount,
+					LBFee:       price.LBAmount.Mul(decimal.NewFromFloat(conf.LBFeeEstimate)),
+					OperatorFee: price.LBAmount.Mul(fee),
+					BotFee:      price.BotFee,
+				}
+				p.Outlet = p.LBAmount.Sub(p.LBFee).Sub(p.OperatorFee).Sub(p.BotFee)
+				if p.Outlet.Sign() > 0 {
+					p.ClientPrice = amount.Div(p.Outlet)
+				}
+				ret = append(ret, p)
+			}
+			return ret
+		},
+	})
+
+	res.AddValidator(&qorres.Validator{
+		Name: "pricing_rule",
+		Handler: func(record interface{}, metaValues *qorres.MetaValues, context *qor.Context) error {
+			rule, ok := record.(*PricingRule)
+			if !ok {
+				return errors.New("unxepected record type")
+			}
+			if rule.Currency != "" && !IsKnownCurrency(rule.Currency) {
+				return validations.NewError(record, "Currency", "unknown currency")
+			}
+			if rule.MaxAmount.Sign() > 0 && rule.MinAmount.Cmp(rule.MaxAmount) > 0 {
+				return validations.NewError(record, "MaxAmount", "maximum is less than minimum")
+			}
+			if rule.Base == proto.PriceBase_Percentile && rule.Percentile > 100 {
+				return validations.NewError(record, "Percentile", "percentile should be from 0 to 100")
+			}
+			if rule.Spread.Sign() < 0 || rule.Spread.Cmp(decimal.New(1, 0)) >= 0 {
+				return validations.NewError(record, "Spread", "spread should be part of amount, from 0 to 1")
+			}
+			if rule.FixedFee.Sign() < 0 || rule.MinFee.Sign() < 0 {
+				return validations.NewError(record, "FixedFee", "fees can not be negative")
+			}
+			return nil
+		},
+	})
+}
+
+func rateSnapshotsInit(res *admin.Resource) {
+	res.SearchAttrs("Currency", "Source")
+	res.IndexAttrs(
+		"ID", "CreatedAt", "Currency", "Minimal", "Median", "Ads", "Source", "Derived",
+	)
+	res.Meta(&admin.Meta{
+		Name: "Chart",
+		Type: "rate_chart",
+		Valuer: func(val interface{}, ctx *qor.Context) interface{} {
+			snapshot, ok := val.(*RateSnapshot)
+			if !ok {
+				return nil
+			}
+			chart, err := loadRateChart(ctx.DB, *snapshot)
+			if err != nil {
+				log.Errorf("failed to build rate chart of snapshot %v: %v", snapshot.ID, err)
+				return nil
+			}
+			return chart
+		},
+	})
+	res.ShowAttrs(&admin.Section{
+		Rows: [][]string{
+			{"ID", "CreatedAt"},
+			{"Currency", "Source"},
+			{"Minimal", "Median"},
+			{"Ads", "Derived"},
+		},
+	}, &admin.Section{
+		Title: "Chart",
+		Rows: [][]string{
+			{"Chart"},
 		},
 	})
 }
@@ -210,6 +669,48 @@ func ordersInit(res *admin.Resource) {
 			return order.OutletAmount()
 		},
 	})
+	res.Meta(&admin.Meta{
+		Name: "History",
+		Type: "timeline",
+		Valuer: func(val interface{}, ctx *qor.Context) interface{} {
+			order, ok := val.(*Order)
+			if !ok {
+				return nil
+			}
+			history, err := LoadOrderHistory(ctx.DB, order.ID)
+			if err != nil {
+				log.Errorf("failed to load history of order %v: %v", order.ID, err)
+				return nil
+			}
+			return history
+		},
+	})
+	res.Meta(&admin.Meta{
+		Name: "Payouts",
+		Type: "payouts",
+		Valuer: func(val interface{}, ctx *qor.Context) interface{} {
+			order, ok := val.(*Order)
+			if !ok {
+				return nil
+			}
+			var ret struct {
+				Payout   Payout
+				Attempts []PayoutAttempt
+			}
+			var err error
+			ret.Payout, err = LoadPayoutByOrder(ctx.DB, order.ID)
+			if err != nil && err != gorm.ErrRecordNotFound {
+				log.Errorf("failed to load payout of order %v: %v", order.ID, err)
+				return nil
+			}
+			ret.Attempts, err = LoadPayoutAttempts(ctx.DB, order.ID)
+			if err != nil {
+				log.Errorf("failed to load payout attempts of order %v: %v", order.ID, err)
+				return nil
+			}
+			return ret
+		},
+	})
 	res.IndexAttrs(
 		"ID", "CreatedAt", "ClientName", "PaymentMethod", "FiatAmount", "Currency", "Status", "OperatorID",
 	)
@@ -223,7 +724,27 @@ func ordersInit(res *admin.Resource) {
 			{"FiatAmount", "Currency"},
 			{"LBAmount", "OutletAmount"},
 			{"LBFee", "OperatorFee"},
-			{"BotFee"},
+			{"BotFee", "QuoteID"},
+			{"FeeTierID", "PricingRuleID"},
+			{"RateSnapshotID", "DerivedRate"},
+		},
+	}, &admin.Section{
+		Title: "Dispute",
+		Rows: [][]string{
+			{"DisputedAt", "DisputedBy"},
+			{"DisputeReason"},
+			{"DisputeVerdict", "DisputeClientPart"},
+			{"DisputeComment"},
+		},
+	}, &admin.Section{
+		Title: "History",
+		Rows: [][]string{
+			{"History"},
+		},
+	}, &admin.Section{
+		Title: "Payouts",
+		Rows: [][]string{
+			{"Payouts"},
 		},
 	})
 
@@ -253,13 +774,9 @@ func ordersInit(res *admin.Resource) {
 				if !ok {
 					return fmt.Errorf("unexpected type %v in mark finished qor action", reflect.TypeOf(record))
 				}
-				if order.Status != proto.OrderStatus_Transfer {
-					return fmt.Errorf("order have unexpected status '%v'", order.Status)
-				}
-				order.Status = proto.OrderStatus_Finished
-				err := order.Save(arg.Context.DB)
+				err := finishPayoutManually(order.ID, AdminActor(arg.Context.CurrentUser))
 				if err != nil {
-					return fmt.Errorf("failed to save order: %v", err)
+					return err
 				}
 			}
 			return nil
@@ -270,9 +787,142 @@ func ordersInit(res *admin.Resource) {
 				log.Errorf("unexpected type %v in visible check of 'mark finished' qor action", reflect.TypeOf(record))
 				return false
 			}
+			return order.Status == proto.OrderStatus_Transfer || order.Status == proto.OrderStatus_PayoutFailed
+		},
+	})
+
+	res.Action(&admin.Action{
+		Name:       "Retry payout now",
+		Modes:      []string{"show", "menu_item"},
+		Permission: roles.Allow(roles.Update, roles.Anyone),
+		Handler: func(arg *admin.ActionArgument) error {
+			for _, record := range arg.FindSelectedRecords() {
+				order, ok := record.(*Order)
+				if !ok {
+					return fmt.Errorf("unexpected type %v in retry payout qor action", reflect.TypeOf(record))
+				}
+				err := retryPayout(order.ID, AdminActor(arg.Context.CurrentUser))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Visible: func(record interface{}, context *admin.Context) bool {
+			order, ok := record.(*Order)
+			if !ok {
+				log.Errorf("unexpected type %v in visible check of 'retry payout' qor action", reflect.TypeOf(record))
+				return false
+			}
+			return order.Status == proto.OrderStatus_Transfer || order.Status == proto.OrderStatus_PayoutFailed
+		},
+	})
+
+	res.Action(&admin.Action{
+		Name:       "Give up payout",
+		Modes:      []string{"show", "menu_item"},
+		Permission: roles.Allow(roles.Update, roles.Anyone),
+		Handler: func(arg *admin.ActionArgument) error {
+			for _, record := range arg.FindSelectedRecords() {
+				order, ok := record.(*Order)
+				if !ok {
+					return fmt.Errorf("unexpected type %v in give up payout qor action", reflect.TypeOf(record))
+				}
+				err := giveUpPayout(order.ID, AdminActor(arg.Context.CurrentUser))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Visible: func(record interface{}, context *admin.Context) bool {
+			order, ok := record.(*Order)
+			if !ok {
+				log.Errorf("unexpected type %v in visible check of 'give up payout' qor action", reflect.TypeOf(record))
+				return false
+			}
 			return order.Status == proto.OrderStatus_Transfer
 		},
 	})
+
+	type verdictArg struct {
+		Comment string
+	}
+	verdictArgRes := res.GetAdmin().NewResource(&verdictArg{})
+	type splitArg struct {
+		// Part of payout which goes to client, from 0 to 1
+		ClientPart decimal.Decimal
+		Comment    string
+	}
+	splitArgRes := res.GetAdmin().NewResource(&splitArg{})
+
+	resolve := func(arg *admin.ActionArgument, verdict proto.DisputeVerdict, clientPart decimal.Decimal, comment string) error {
+		if comment == "" {
+			return errors.New("comment is required")
+		}
+		for _, record := range arg.FindSelectedRecords() {
+			order, ok := record.(*Order)
+			if !ok {
+				return fmt.Errorf("unexpected type %v in resolve dispute qor action", reflect.TypeOf(record))
+			}
+			err := resolveDispute(order.ID, verdict, clientPart, comment, AdminActor(arg.Context.CurrentUser))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	disputed := func(record interface{}, context *admin.Context) bool {
+		order, ok := record.(*Order)
+		if !ok {
+			log.Errorf("unexpected type %v in visible check of resolve dispute qor action", reflect.TypeOf(record))
+			return false
+		}
+		return order.Status == proto.OrderStatus_Disputed
+	}
+
+	res.Action(&admin.Action{
+		Name:       "Pay client",
+		Resource:   verdictArgRes,
+		Modes:      []string{"show", "menu_item"},
+		Permission: roles.Allow(roles.Update, roles.Anyone),
+		Handler: func(argument *admin.ActionArgument) error {
+			arg, ok := argument.Argument.(*verdictArg)
+			if !ok {
+				return errors.New("unxepected argument type")
+			}
+			return resolve(argument, proto.DisputeVerdict_PayClient, decimal.Zero, arg.Comment)
+		},
+		Visible: disputed,
+	})
+	res.Action(&admin.Action{
+		Name:       "Return to operator",
+		Resource:   verdictArgRes,
+		Modes:      []string{"show", "menu_item"},
+		Permission: roles.Allow(roles.Update, roles.Anyone),
+		Handler: func(argument *admin.ActionArgument) error {
+			arg, ok := argument.Argument.(*verdictArg)
+			if !ok {
+				return errors.New("unxepected argument type")
+			}
+			return resolve(argument, proto.DisputeVerdict_ReturnToOperator, decimal.Zero, arg.Comment)
+		},
+		Visible: disputed,
+	})
+	res.Action(&admin.Action{
+		Name:       "Split",
+		Resource:   splitArgRes,
+		Modes:      []string{"show", "menu_item"},
+		Permission: roles.Allow(roles.Update, roles.Anyone),
+		Handler: func(argument *admin.ActionArgument) error {
+			arg, ok := argument.Argument.(*splitArg)
+			if !ok {
+				return errors.New("unxepected argument type")
+			}
+			return resolve(argument, proto.DisputeVerdict_Split, arg.ClientPart, arg.Comment)
+		},
+		Visible: disputed,
+	})
 }
 
 type DummyAuth struct{}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"common/db"
+	"common/log"
+	"core/proto"
+	"errors"
+	"github.com/jinzhu/gorm"
+	"github.com/shopspring/decimal"
+	"time"
+)
+
+type Quote struct {
+	db.Model
+	Currency      string
+	FiatAmount    decimal.Decimal `gorm:"type:decimal"`
+	PaymentMethod string
+	LBAmount      decimal.Decimal `gorm:"type:decimal"`
+	LBFee         decimal.Decimal `gorm:"type:decimal"`
+	OperatorFee   decimal.Decimal `gorm:"type:decimal"`
+	BotFee        decimal.Decimal `gorm:"type:decimal"`
+	// Zero for default pricing
+	PricingRuleID  uint64
+	RateSnapshotID uint64
+	// Rate is derived from other currency
+	DerivedRate bool
+	ExpiresAt   time.Time
+}
+
+func (q Quote) OutletAmount() decimal.Decimal {
+	return q.LBAmount.Sub(q.LBFee).Sub(q.OperatorFee).Sub(q.BotFee)
+}
+
+func (q Quote) Encode() proto.Quote {
+	return proto.Quote{
+		ID:            q.ID,
+		Currency:      q.Currency,
+		FiatAmount:    q.FiatAmount,
+		PaymentMethod: q.PaymentMethod,
+		LBAmount:      q.LBAmount,
+		LBFee:         q.LBFee,
+		OperatorFee:   q.OperatorFee,
+		BotFee:        q.BotFee,
+		OutletAmount:  q.OutletAmount(),
+		DerivedRate:   q.DerivedRate,
+		ExpiresAt:     q.ExpiresAt,
+	}
+}
+
+// Loads quote and checks whether it is still valid for passed order parameters
+func LoadQuoteForOrder(db *gorm.DB, id uint64, req proto.Order) (Quote, error) {
+	var quote Quote
+	scope := db.First(&quote, "id = ?", id)
+	switch {
+	case scope.RecordNotFound():
+		return quote, errors.New("unknown quote")
+	case scope.Error != nil:
+		log.Errorf("failed to load quote %v: %v", id, scope.Error)
+		return quote, errors.New(proto.DBError)
+	}
+
+	if time.Now().After(quote.ExpiresAt) {
+		return quote, errors.New("quote expired")
+	}
+	if quote.Currency != req.Currency || quote.PaymentMethod != req.PaymentMethod ||
+		!quote.FiatAmount.Equal(req.FiatAmount) {
+		return quote, errors.New("quote does not match order")
+	}
+	return quote, nil
+}
+
+func GetQuote(req proto.QuoteRequest) (proto.Quote, error) {
+	if req.FiatAmount.Sign() <= 0 {
+		return proto.Quote{}, errors.New("invalid fiat amount")
+	}
+	if !IsKnownCurrency(req.Currency) {
+		return proto.Quote{}, errors.New("unknown currency")
+	}
+	if !IsKnownPaymentMethod(req.PaymentMethod, req.Currency) {
+		return proto.Quote{}, errors.New("unknown payment method")
+	}
+
+	price, err := PriceOrder(req.Currency, req.PaymentMethod, req.FiatAmount)
+	if err != nil {
+		return proto.Quote{}, err
+	}
+
+	fee, err := maxOperatorFeeRate(db.New())
+	if err != nil {
+		log.Errorf("failed to load fee tiers: %v", err)
+		return proto.Quote{}, errors.New(proto.DBError)
+	}
+
+	lbAmount := price.LBAmount
+	quote := Quote{
+		Currency:       req.Currency,
+		FiatAmount:     req.FiatAmount,
+		PaymentMethod:  req.PaymentMethod,
+		LBAmount:       lbAmount,
+		LBFee:          lbAmount.Mul(decimal.NewFromFloat(conf.LBFeeEstimate)),
+		OperatorFee:    lbAmount.Mul(fee),
+		BotFee:         price.BotFee,
+		PricingRuleID:  price.RuleID,
+		RateSnapshotID: price.RateSnapshotID,
+		DerivedRate:    price.DerivedRate,
+		ExpiresAt:      time.Now().Add(conf.QuoteTTL),
+	}
+	err = db.New().Create(&quote).Error
+	if err != nil {
+		log.Errorf("failed to save quote: %v", err)
+		return proto.Quote{}, errors.New(proto.DBError)
+	}
+
+	return quote.Encode(), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"common/log"
+	"common/rabbit"
+	"core/proto"
+	"errors"
+	"github.com/shopspring/decimal"
+	"sort"
+)
+
+// Rate events are published directly rather than through outbox: they are not persisted
+// and a lost one is superseded by the next change anyway.
+
+func init() {
+	rabbit.AddPublishers(rabbit.Publisher{
+		Name:   "rate_event",
+		Routes: []rabbit.Route{proto.RateEventRoute},
+	})
+}
+
+func encodeRate(currency string, node RateNode) proto.Rate {
+	return proto.Rate{
+		Currency:  currency,
+		Minimal:   node.Minimal,
+		Median:    node.Median,
+		Ads:       node.Ads,
+		Source:    node.Source,
+		Derived:   node.Derived,
+		CheckedAt: node.CheckedAt,
+	}
+}
+
+// Whether value differs from previous one more than threshold part
+func rateMoved(prev, value decimal.Decimal) bool {
+	if prev.Sign() == 0 {
+		return value.Sign() != 0
+	}
+	diff, _ := value.Sub(prev).Div(prev).Abs().Float64()
+	return diff > conf.RateEventThreshold
+}
+
+// Publishes rate of currency if it changed enough since last published one
+func publishRateChange(currency string) {
+	rateMapLock.Lock()
+	entry, ok := rateMap[currency]
+	if !ok || entry.node.CheckedAt.IsZero() ||
+		!rateMoved(entry.published.Minimal, entry.node.Minimal) && !rateMoved(entry.published.Median, entry.node.Median) {
+		rateMapLock.Unlock()
+		return
+	}
+	entry.published = entry.node
+	node := entry.node
+	rateMapLock.Unlock()
+
+	err := rabbit.Publish("rate_event", "", encodeRate(currency, node))
+	if err != nil {
+		log.Errorf("failed to publish %v rate event: %v", currency, err)
+	}
+}
+
+func GetRates(currency string) ([]proto.Rate, error) {
+	if currency != "" {
+		if !IsKnownCurrency(currency) {
+			return nil, errors.New("unknown currency")
+		}
+		node, err := GetExchangeRate(currency)
+		if err != nil {
+			return nil, errors.New(proto.StaleRateError)
+		}
+		return []proto.Rate{encodeRate(currency, node)}, nil
+	}
+
+	known := map[string]bool{}
+	for _, cur := range conf.PrefetchRates {
+		known[cur] = true
+	}
+	rateMapLock.Lock()
+	for cur := range rateMap {
+		known[cur] = true
+	}
+	rateMapLock.Unlock()
+	currencies := make([]string, 0, len(known))
+	for cur := range known {
+		currencies = append(currencies, cur)
+	}
+	sort.Strings(currencies)
+
+	// Stale rates are skipped
+	ret := []proto.Rate{}
+	for _, cur := range currencies {
+		node, err := GetExchangeRate(cur)
+		if err == nil {
+			ret = append(ret, encodeRate(cur, node))
+		}
+	}
+	return ret, nil
+}
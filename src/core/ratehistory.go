@@ -0,0 +1,194 @@
+package main
+
+import (
+	"common/db"
+	"common/log"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/shopspring/decimal"
+	"strings"
+	"time"
+)
+
+// Every successful refresh of rate is saved, order keeps snapshot it was priced with.
+// Snapshots older than DownsampleAfter are thinned to the first one per currency and DownsampleInterval,
+// ones older than Retention are deleted. Snapshots referenced by orders are never deleted.
+
+type RateSnapshot struct {
+	ID        uint64
+	Currency  string          `gorm:"index"`
+	Minimal   decimal.Decimal `gorm:"type:decimal"`
+	Median    decimal.Decimal `gorm:"type:decimal"`
+	Ads       int
+	Source    string
+	Derived   bool
+	CreatedAt time.Time `gorm:"index"`
+}
+
+func saveRateSnapshot(currency string, node RateNode) (uint64, error) {
+	snapshot := RateSnapshot{
+		Currency:  currency,
+		Minimal:   node.Minimal,
+		Median:    node.Median,
+		Ads:       node.Ads,
+		Source:    node.Source,
+		Derived:   node.Derived,
+		CreatedAt: node.CheckedAt,
+	}
+	err := db.New().Create(&snapshot).Error
+	return snapshot.ID, err
+}
+
+const unreferencedSnapshot = "NOT EXISTS (SELECT 1 FROM orders WHERE rate_snapshot_id = rate_snapshots.id)"
+
+func cleanupRateHistory() error {
+	cfg := conf.RatesHistory
+	now := time.Now()
+	err := db.New().Delete(&RateSnapshot{},
+		"created_at < ? AND "+unreferencedSnapshot, now.Add(-cfg.Retention),
+	).Error
+	if err != nil {
+		return fmt.Errorf("failed to delete old snapshots: %v", err)
+	}
+
+	before := now.Add(-cfg.DownsampleAfter)
+	return db.New().Exec(`
+		DELETE FROM rate_snapshots WHERE created_at < ? AND `+unreferencedSnapshot+` AND id NOT IN (
+			SELECT MIN(id) FROM rate_snapshots WHERE created_at < ?
+			GROUP BY currency, FLOOR(EXTRACT(EPOCH FROM created_at) / ?)
+		)`, before, before, int64(cfg.DownsampleInterval/time.Second),
+	).Error
+}
+
+func RatesHistoryLoop() {
+	for {
+		err := cleanupRateHistory()
+		if err != nil {
+			log.Errorf("failed to cleanup rate history: %v", err)
+		}
+		time.Sleep(conf.RatesHistory.Tick)
+	}
+}
+
+// Chart of rates around snapshot and fiat volume of orders created at the same time, coordinates are in pixels
+type rateChart struct {
+	Currency string
+	From     time.Time
+	To       time.Time
+	Width    int
+	Height   int
+
+	MinRate       decimal.Decimal
+	MaxRate       decimal.Decimal
+	MinimalPoints string
+	MedianPoints  string
+	// Position of snapshot chart is built for
+	SnapshotX float64
+
+	MaxVolume decimal.Decimal
+	Bars      []rateChartBar
+}
+
+type rateChartBar struct {
+	X      float64
+	Y      float64
+	Width  float64
+	Height float64
+	From   time.Time
+	Volume decimal.Decimal
+	Orders int
+}
+
+const (
+	rateChartPeriod = 7 * 24 * time.Hour
+	rateChartBars   = 56
+	rateChartWidth  = 800
+	rateChartHeight = 300
+)
+
+func loadRateChart(db *gorm.DB, snapshot RateSnapshot) (rateChart, error) {
+	chart := rateChart{
+		Currency: snapshot.Currency,
+		From:     snapshot.CreatedAt.Add(-rateChartPeriod / 2),
+		To:       snapshot.CreatedAt.Add(rateChartPeriod / 2),
+		Width:    rateChartWidth,
+		Height:   rateChartHeight,
+	}
+	if now := time.Now(); chart.To.After(now) {
+		chart.To = now
+	}
+	period := chart.To.Sub(chart.From)
+	x := func(t time.Time) float64 {
+		return float64(t.Sub(chart.From)) / float64(period) * rateChartWidth
+	}
+	chart.SnapshotX = x(snapshot.CreatedAt)
+
+	var snapshots []RateSnapshot
+	err := db.Order("created_at").Find(&snapshots, "currency = ? AND created_at BETWEEN ? AND ?",
+		snapshot.Currency, chart.From, chart.To).Error
+	if err != nil {
+		return chart, fmt.Errorf("failed to load snapshots: %v", err)
+	}
+	for i, s := range snapshots {
+		if i == 0 || s.Minimal.Cmp(chart.MinRate) < 0 {
+			chart.MinRate = s.Minimal
+		}
+		if i == 0 || s.Median.Cmp(chart.MaxRate) > 0 {
+			chart.MaxRate = s.Median
+		}
+	}
+	rateRange, _ := chart.MaxRate.Sub(chart.MinRate).Float64()
+	y := func(rate decimal.Decimal) float64 {
+		if rateRange == 0 {
+			return rateChartHeight / 2
+		}
+		part, _ := rate.Sub(chart.MinRate).Float64()
+		return rateChartHeight - part/rateRange*rateChartHeight
+	}
+	var minimal, median []string
+	for _, s := range snapshots {
+		minimal = append(minimal, fmt.Sprintf("%.1f,%.1f", x(s.CreatedAt), y(s.Minimal)))
+		median = append(median, fmt.Sprintf("%.1f,%.1f", x(s.CreatedAt), y(s.Median)))
+	}
+	chart.MinimalPoints = strings.Join(minimal, " ")
+	chart.MedianPoints = strings.Join(median, " ")
+
+	var orders []Order
+	err = db.Select("created_at, fiat_amount").Find(&orders, "currency = ? AND created_at BETWEEN ? AND ?",
+		snapshot.Currency, chart.From, chart.To).Error
+	if err != nil {
+		return chart, fmt.Errorf("failed to load orders: %v", err)
+	}
+	barPeriod := period / rateChartBars
+	if barPeriod <= 0 {
+		return chart, nil
+	}
+	chart.Bars = make([]rateChartBar, rateChartBars)
+	for i := range chart.Bars {
+		chart.Bars[i].From = chart.From.Add(time.Duration(i) * barPeriod)
+	}
+	for _, order := range orders {
+		i := int(order.CreatedAt.Sub(chart.From) / barPeriod)
+		if i >= rateChartBars {
+			i = rateChartBars - 1
+		}
+		chart.Bars[i].Volume = chart.Bars[i].Volume.Add(order.FiatAmount)
+		chart.Bars[i].Orders++
+		if chart.Bars[i].Volume.Cmp(chart.MaxVolume) > 0 {
+			chart.MaxVolume = chart.Bars[i].Volume
+		}
+	}
+	maxVolume, _ := chart.MaxVolume.Float64()
+	for i := range chart.Bars {
+		bar := &chart.Bars[i]
+		bar.X = x(bar.From)
+		bar.Width = float64(rateChartWidth) / rateChartBars
+		if maxVolume > 0 {
+			volume, _ := bar.Volume.Float64()
+			// Volume takes lower third of chart
+			bar.Height = volume / maxVolume * rateChartHeight / 3
+		}
+		bar.Y = rateChartHeight - bar.Height
+	}
+	return chart, nil
+}
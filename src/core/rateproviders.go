@@ -0,0 +1,306 @@
+package main
+
+import (
+	"common/log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"io/ioutil"
+	"lbapi"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Source of exchange rates. Providers of currency are set in config and tried in order until one succeeds.
+type RateProvider interface {
+	Name() string
+	Fetch(currency string) (RateNode, error)
+}
+
+var rateProviders = map[string]RateProvider{}
+
+const defaultRateProvider = "lb"
+
+func initRateProviders() {
+	cfg := conf.RateProviders
+	rateProviders = map[string]RateProvider{
+		"lb":     lbAdsProvider{filter: cfg.LB},
+		"static": staticRateProvider{rates: cfg.Static},
+	}
+	if cfg.File != "" {
+		rateProviders["file"] = fileRateProvider{path: cfg.File}
+	}
+	if cfg.Derived.Liquid != "" {
+		rateProviders["derived"] = derivedRateProvider{
+			lb:         lbAdsProvider{filter: cfg.LB},
+			liquid:     cfg.Derived.Liquid,
+			crossRates: cfg.Derived.CrossRates,
+		}
+	}
+
+	if len(cfg.Default) == 0 {
+		conf.RateProviders.Default = []string{defaultRateProvider}
+	}
+	check := func(names []string) {
+		for _, name := range names {
+			if _, ok := rateProviders[name]; !ok {
+				log.Fatalf("unknown rate provider '%v'", name)
+			}
+		}
+	}
+	check(conf.RateProviders.Default)
+	for _, names := range cfg.Currencies {
+		check(names)
+	}
+}
+
+func currencyRateProviders(currency string) []string {
+	names, ok := conf.RateProviders.Currencies[currency]
+	if !ok {
+		return conf.RateProviders.Default
+	}
+	return names
+}
+
+type decimals []decimal.Decimal
+
+func (d decimals) Len() int           { return len(d) }
+func (d decimals) Less(i, j int) bool { return d[i].Cmp(d[j]) < 0 }
+func (d decimals) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// Node from passed prices, they are sorted in place
+func rateNodeFromPrices(source string, prices []decimal.Decimal) RateNode {
+	sort.Sort(decimals(prices))
+	return RateNode{
+		Minimal:   prices[0],
+		Median:    prices[len(prices)/2],
+		Prices:    prices,
+		Ads:       len(prices),
+		Source:    source,
+		CheckedAt: time.Now(),
+	}
+}
+
+// Filters of lb offers used for rates
+type RateAdsFilter struct {
+	MinFeedbackScore float32
+	MinTradeCount    uint64
+	// Offer should accept orders of this fiat amount, zero disables check
+	ReferenceVolume decimal.Decimal
+	// Offers which price differs from median more than this part are dropped, zero disables check
+	MaxDeviation float64
+	// Provider fails if there are less suitable offers, so the next one is tried
+	MinAds int
+}
+
+type lbAdsProvider struct {
+	filter RateAdsFilter
+}
+
+func (lbAdsProvider) Name() string {
+	return "lb"
+}
+
+// Trade count of profile looks like "10 000+"
+func parseTradeCount(count string) uint64 {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, count)
+	ret, _ := strconv.ParseUint(digits, 10, 64)
+	return ret
+}
+
+func (p lbAdsProvider) suitable(ad lbapi.Advertisement) bool {
+	data := ad.Data
+	if !data.Visible || data.HiddenByOpeningHours || data.TempPrice.Sign() <= 0 {
+		return false
+	}
+	if data.Profile.FeedbackScore < p.filter.MinFeedbackScore ||
+		parseTradeCount(data.Profile.TradeCount) < p.filter.MinTradeCount {
+		return false
+	}
+	if ref := p.filter.ReferenceVolume; ref.Sign() > 0 {
+		if data.MinAmount.Cmp(ref) > 0 || (data.MaxAmount.Sign() > 0 && data.MaxAmount.Cmp(ref) < 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Prices of suitable offers of currency, price picks the price of offer
+func (p lbAdsProvider) prices(currency string, price func(lbapi.Advertisement) decimal.Decimal) ([]decimal.Decimal, error) {
+	ads, err := conf.LBKey.BuyOnlineList(currency)
+	if err != nil {
+		return nil, err
+	}
+	var prices []decimal.Decimal
+	for _, ad := range ads {
+		if p.suitable(ad) && price(ad).Sign() > 0 {
+			prices = append(prices, price(ad))
+		}
+	}
+	if len(prices) == 0 {
+		return nil, errors.New("no offers available")
+	}
+	if len(prices) < p.filter.MinAds {
+		return nil, fmt.Errorf("only %v offers available", len(prices))
+	}
+	return prices, nil
+}
+
+// Node from prices of offers without outliers
+func (p lbAdsProvider) node(source, currency string, prices []decimal.Decimal) RateNode {
+	node := rateNodeFromPrices(source, prices)
+	if p.filter.MaxDeviation <= 0 {
+		return node
+	}
+	maxDiff := node.Median.Mul(decimal.NewFromFloat(p.filter.MaxDeviation))
+	var kept []decimal.Decimal
+	for _, price := range node.Prices {
+		if price.Sub(node.Median).Abs().Cmp(maxDiff) <= 0 {
+			kept = append(kept, price)
+		}
+	}
+	if len(kept) < len(node.Prices) {
+		log.Debug("%v outliers of %v offers were dropped for %v", len(node.Prices)-len(kept), len(node.Prices), currency)
+	}
+	return rateNodeFromPrices(source, kept)
+}
+
+func (p lbAdsProvider) Fetch(currency string) (RateNode, error) {
+	prices, err := p.prices(currency, func(ad lbapi.Advertisement) decimal.Decimal {
+		return ad.Data.TempPrice
+	})
+	if err != nil {
+		return RateNode{}, err
+	}
+	return p.node(p.Name(), currency, prices), nil
+}
+
+// Rate of thin currency derived from USD price of liquid currency offers and cross rate of currency to USD.
+// Cross rate is taken from config or is median ratio of local and USD prices across offers of currency.
+type derivedRateProvider struct {
+	lb lbAdsProvider
+	// Currency which offers give USD price
+	liquid string
+	// Fiat of currency per USD
+	crossRates map[string]decimal.Decimal
+}
+
+func (derivedRateProvider) Name() string {
+	return "derived"
+}
+
+func (p derivedRateProvider) crossRate(currency string) (decimal.Decimal, error) {
+	if rate := p.crossRates[currency]; rate.Sign() > 0 {
+		return rate, nil
+	}
+	ads, err := conf.LBKey.BuyOnlineList(currency)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	var ratios []decimal.Decimal
+	for _, ad := range ads {
+		if ad.Data.TempPrice.Sign() > 0 && ad.Data.TempPriceUSD.Sign() > 0 {
+			ratios = append(ratios, ad.Data.TempPrice.Div(ad.Data.TempPriceUSD))
+		}
+	}
+	if len(ratios) == 0 {
+		return decimal.Decimal{}, errors.New("no cross rate")
+	}
+	sort.Sort(decimals(ratios))
+	return ratios[len(ratios)/2], nil
+}
+
+func (p derivedRateProvider) Fetch(currency string) (RateNode, error) {
+	if currency == p.liquid {
+		return RateNode{}, errors.New("currency is liquid one")
+	}
+	cross, err := p.crossRate(currency)
+	if err != nil {
+		return RateNode{}, err
+	}
+	prices, err := p.lb.prices(p.liquid, func(ad lbapi.Advertisement) decimal.Decimal {
+		return ad.Data.TempPriceUSD
+	})
+	if err != nil {
+		return RateNode{}, fmt.Errorf("%v offers: %v", p.liquid, err)
+	}
+	for i := range prices {
+		prices[i] = prices[i].Mul(cross)
+	}
+	node := p.lb.node(p.Name(), currency, prices)
+	node.Derived = true
+	return node, nil
+}
+
+// Rates set manually
+type StaticRate struct {
+	Minimal decimal.Decimal
+	Median  decimal.Decimal
+}
+
+func (r StaticRate) node(source string) (RateNode, error) {
+	if r.Minimal.Sign() <= 0 {
+		return RateNode{}, errors.New("invalid rate")
+	}
+	median := r.Median
+	if median.Sign() <= 0 {
+		median = r.Minimal
+	}
+	return RateNode{
+		Minimal:   r.Minimal,
+		Median:    median,
+		Source:    source,
+		CheckedAt: time.Now(),
+	}, nil
+}
+
+// Overrides rates by values from config
+type staticRateProvider struct {
+	rates map[string]StaticRate
+}
+
+func (staticRateProvider) Name() string {
+	return "static"
+}
+
+func (p staticRateProvider) Fetch(currency string) (RateNode, error) {
+	rate, ok := p.rates[currency]
+	if !ok {
+		return RateNode{}, errors.New("no static rate")
+	}
+	return rate.node(p.Name())
+}
+
+// Reads rates from json file like {"RUB": {"Minimal": "1000000", "Median": "1010000"}}, file is reread on every fetch
+type fileRateProvider struct {
+	path string
+}
+
+func (fileRateProvider) Name() string {
+	return "file"
+}
+
+func (p fileRateProvider) Fetch(currency string) (RateNode, error) {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return RateNode{}, err
+	}
+	var rates map[string]StaticRate
+	err = json.Unmarshal(data, &rates)
+	if err != nil {
+		return RateNode{}, fmt.Errorf("failed to parse %v: %v", p.path, err)
+	}
+	rate, ok := rates[currency]
+	if !ok {
+		return RateNode{}, fmt.Errorf("no rate in %v", p.path)
+	}
+	return rate.node(p.Name())
+}
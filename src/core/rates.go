@@ -2,95 +2,213 @@ package main
 
 import (
 	"common/log"
+	"fmt"
 	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
+	"strings"
 	"sync"
 	"time"
 )
 
 const RateRefreshTickDefault = 5 * time.Minute
 
-// @TODO Any filters?
-
 type RateNode struct {
-	Minimal   decimal.Decimal
-	Median    decimal.Decimal
+	Minimal decimal.Decimal
+	Median  decimal.Decimal
+	// Prices of all offers from the best one, empty if provider does not use offers
+	Prices []decimal.Decimal
+	// Number of offers rate is based on
+	Ads int
+	// Name of provider
+	Source    string
 	CheckedAt time.Time
+	// Saved copy of rate, zero if it was not saved
+	SnapshotID uint64
+	// Rate is built from offers of other currency
+	Derived bool
+}
+
+// Price of offer which is better than passed percent of offers
+func (node RateNode) Percentile(percent uint) decimal.Decimal {
+	if len(node.Prices) == 0 || percent > 100 {
+		return node.Minimal
+	}
+	return node.Prices[int(percent)*(len(node.Prices)-1)/100]
 }
 
+// Last good rate of currency is kept while its refresh fails, failed refreshes are retried
+// with growing delays. Rate older than RatesMaxAge is not returned at all.
+type rateEntry struct {
+	// Zero until the first successful fetch
+	node RateNode
+	// Currency was not prefetched, but requested
+	onDemand bool
+	// Last rate sent as rate_event
+	published RateNode
+	// Number of failed fetches in a row
+	failures     uint
+	failingSince time.Time
+	nextFetch    time.Time
+}
+
+// Returned when currency has no rate which is fresh enough to be used
+type StaleRateError struct {
+	Currency string
+	// Zero if rate was never fetched
+	CheckedAt time.Time
+}
+
+func (e StaleRateError) Error() string {
+	if e.CheckedAt.IsZero() {
+		return fmt.Sprintf("no rate for %v", e.Currency)
+	}
+	return fmt.Sprintf("rate for %v is stale, it was checked at %v", e.Currency, e.CheckedAt)
+}
+
+// Interval between checks of currencies which should be refreshed
+const rateCheckTick = 5 * time.Second
+
 var (
-	// List of currencies to refresh
-	activeList  []string
-	rateMap     = map[string]RateNode{}
-	rateMapLock sync.RWMutex
+	rateMap     = map[string]*rateEntry{}
+	rateMapLock sync.Mutex
 )
 
-func RatesRefresh(prefetch []string) {
-	activeList = prefetch
-
-	var tick time.Duration = RateRefreshTickDefault
+func ratesRefreshTick() time.Duration {
 	if conf.RatesRefreshTick != "" {
 		parsed, err := time.ParseDuration(conf.RatesRefreshTick)
 		if err != nil || parsed < time.Second {
 			log.Errorf("invalid RateRefreshTick '%v'", conf.RatesRefreshTick)
 		} else {
-			tick = parsed
+			return parsed
 		}
 	}
+	return RateRefreshTickDefault
+}
 
-	fetchAll()
-
-	for range time.Tick(tick) {
-		fetchAll()
+// Delay before next fetch after passed number of failed ones
+func rateBackoff(failures uint) time.Duration {
+	delay := conf.RatesRetry.BaseDelay
+	for i := uint(1); i < failures && delay < conf.RatesRetry.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > conf.RatesRetry.MaxDelay {
+		delay = conf.RatesRetry.MaxDelay
 	}
+	return delay
 }
 
-func fetchRate(currency string) (RateNode, error) {
-	ad, err := conf.LBKey.BuyOnlineList(currency)
+func (entry *rateEntry) update(node RateNode, err error) {
+	now := time.Now()
 	if err != nil {
-		return RateNode{}, err
+		if entry.failures == 0 {
+			entry.failingSince = now
+		}
+		entry.failures++
+		entry.nextFetch = now.Add(rateBackoff(entry.failures))
+		return
 	}
-	if len(ad) == 0 {
-		return RateNode{}, errors.New("no offers available")
+	entry.node = node
+	entry.failures = 0
+	entry.failingSince = time.Time{}
+	if entry.onDemand {
+		entry.nextFetch = now.Add(conf.RatesOnDemandTick)
+	} else {
+		entry.nextFetch = now.Add(ratesRefreshTick())
 	}
-	// Results should be sorted(i believe), so just take first and middle values
-	return RateNode{
-		Minimal:   ad[0].Data.TempPrice,
-		Median:    ad[len(ad)/2].Data.TempPrice,
-		CheckedAt: time.Now(),
-	}, nil
 }
 
-func fetchAll() {
-	for _, currency := range activeList {
-		node, err := fetchRate(currency)
-		if err != nil {
-			log.Errorf("failed to update rate for currency %v: %v", currency, err)
+// Runs on leader only, followers fetch rates on demand
+func RatesRefresh(prefetch []string) {
+	rateMapLock.Lock()
+	for _, currency := range prefetch {
+		entry, ok := rateMap[currency]
+		if !ok {
+			entry = &rateEntry{}
+			rateMap[currency] = entry
+		}
+		entry.onDemand = false
+	}
+	rateMapLock.Unlock()
+
+	for {
+		refreshDueRates()
+		time.Sleep(rateCheckTick)
+	}
+}
+
+// Tries providers of currency in order
+func fetchRate(currency string) (RateNode, error) {
+	var errs []string
+	for _, name := range currencyRateProviders(currency) {
+		node, err := rateProviders[name].Fetch(currency)
+		if err == nil {
+			return node, nil
 		}
-		rateMapLock.Lock()
-		rateMap[currency] = node
-		rateMapLock.Unlock()
+		errs = append(errs, fmt.Sprintf("%v: %v", name, err))
 	}
+	return RateNode{}, errors.New(strings.Join(errs, "; "))
 }
 
-func GetExchangeRate(currency string) (RateNode, error) {
-	rateMapLock.RLock()
-	node, ok := rateMap[currency]
-	rateMapLock.RUnlock()
+func refreshDueRates() {
+	now := time.Now()
+	var due []string
+	rateMapLock.Lock()
+	for currency, entry := range rateMap {
+		if !now.Before(entry.nextFetch) {
+			due = append(due, currency)
+		}
+	}
+	rateMapLock.Unlock()
 
-	if ok {
-		return node, nil
+	for _, currency := range due {
+		refreshRate(currency)
+		publishRateChange(currency)
 	}
+}
 
+// Fetches rate and returns last good one
+func refreshRate(currency string) RateNode {
 	node, err := fetchRate(currency)
+	if err == nil {
+		node.SnapshotID, err = saveRateSnapshot(currency, node)
+		if err != nil {
+			log.Errorf("failed to save %v rate snapshot: %v", currency, err)
+			err = nil
+		}
+	}
+
+	rateMapLock.Lock()
+	defer rateMapLock.Unlock()
+	entry, ok := rateMap[currency]
+	if !ok {
+		entry = &rateEntry{onDemand: true}
+		rateMap[currency] = entry
+	}
+	entry.update(node, err)
 	if err != nil {
-		return node, err
+		log.Errorf("failed to update rate for currency %v(failing for %v, retry in %v): %v",
+			currency, time.Since(entry.failingSince), entry.nextFetch.Sub(time.Now()), err)
 	}
+	return entry.node
+}
 
+// Returns StaleRateError if there is no rate younger than RatesMaxAge
+func GetExchangeRate(currency string) (RateNode, error) {
 	rateMapLock.Lock()
-	rateMap[currency] = node
-	activeList = append(activeList, currency)
+	entry, ok := rateMap[currency]
+	var node RateNode
+	// Rates are refreshed by leader, followers and unknown currencies fetch them on demand
+	due := !ok || (!IsLeader() && !time.Now().Before(entry.nextFetch))
+	if ok {
+		node = entry.node
+	}
 	rateMapLock.Unlock()
 
+	if due {
+		node = refreshRate(currency)
+	}
+	if node.CheckedAt.IsZero() || time.Since(node.CheckedAt) > conf.RatesMaxAge {
+		return node, StaleRateError{Currency: currency, CheckedAt: node.CheckedAt}
+	}
 	return node, nil
 }
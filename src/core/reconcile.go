@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"common/db"
+	"common/log"
+	"core/proto"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// Reconciliation fixes operators and orders left inconsistent by crash of core. Rules:
+//  - operator in proposal status with order which is not new anymore becomes ready;
+//  - operator busy with missing order, order of other operator or order which does not need operator
+//    anymore is released: becomes inactive if order reached transfer(as after confirmation) or ready otherwise;
+//  - active order whose operator is not busy with it is attached back to operator if it is not busy with other order,
+//    otherwise accepted order is dropped, since client did not get requisites yet,
+//    and order with linked lb contact is only reported, because money could be moving already.
+// Operators are checked before orders, so released operators can be attached to their orders in the same pass.
+
+var ReconcileActor = Actor{Kind: proto.ActorKind_System, Name: "reconcile"}
+
+// Statuses in which order needs busy operator
+var activeOrderStatuses = []proto.OrderStatus{
+	proto.OrderStatus_Accepted,
+	proto.OrderStatus_Linked,
+	proto.OrderStatus_Payment,
+	proto.OrderStatus_Confirmation,
+	proto.OrderStatus_ConfirmationExtended,
+	proto.OrderStatus_Disputed,
+}
+
+func isActiveOrderStatus(status proto.OrderStatus) bool {
+	for _, s := range activeOrderStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Operator status after order was completed with passed status
+func releasedOperatorStatus(status proto.OrderStatus) proto.OperatorStatus {
+	switch status {
+	case proto.OrderStatus_Transfer, proto.OrderStatus_Finished, proto.OrderStatus_PayoutFailed:
+		return proto.OperatorStatus_Inactive
+	}
+	return proto.OperatorStatus_Ready
+}
+
+type reconcileIssue struct {
+	OperatorID uint64
+	OrderID    uint64
+	Problem    string
+	Fix        string
+	Fixed      bool
+	Err        error
+}
+
+type reconcileReport struct {
+	DryRun bool
+	Issues []reconcileIssue
+}
+
+func (r reconcileReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "reconciliation found %v issues", len(r.Issues))
+	if r.DryRun {
+		buf.WriteString(" (dry run)")
+	}
+	buf.WriteString("\n")
+	for _, issue := range r.Issues {
+		fmt.Fprintf(&buf, "operator %v, order %v: %v -> %v", issue.OperatorID, issue.OrderID, issue.Problem, issue.Fix)
+		switch {
+		case issue.Err != nil:
+			fmt.Fprintf(&buf, " [failed: %v]", issue.Err)
+		case issue.Fixed:
+			buf.WriteString(" [fixed]")
+		case !r.DryRun:
+			buf.WriteString(" [not fixed]")
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+type operatorFix struct {
+	problem string
+	fix     string
+	updates map[string]interface{}
+}
+
+// Checks operator against its current order, order is nil if it does not exist
+func diagnoseOperator(op Operator, order *Order) *operatorFix {
+	switch op.Status {
+	case proto.OperatorStatus_Proposal:
+		if order == nil || order.Status != proto.OrderStatus_New {
+			problem := "proposal of missing order"
+			if order != nil {
+				problem = fmt.Sprintf("proposal of order in status '%v'", order.Status)
+			}
+			return &operatorFix{
+				problem: problem,
+				fix:     "set operator ready",
+				updates: map[string]interface{}{
+					"status": proto.OperatorStatus_Ready,
+				},
+			}
+		}
+
+	case proto.OperatorStatus_Busy:
+		var problem string
+		status := proto.OperatorStatus_Ready
+		switch {
+		case order == nil:
+			problem = "busy with missing order"
+		case order.OperatorID != op.ID:
+			problem = fmt.Sprintf("busy with order of operator %v", order.OperatorID)
+		case !isActiveOrderStatus(order.Status):
+			problem = fmt.Sprintf("busy with order in status '%v'", order.Status)
+			status = releasedOperatorStatus(order.Status)
+		default:
+			return nil
+		}
+		return &operatorFix{
+			problem: problem,
+			fix:     fmt.Sprintf("set operator %v", status),
+			updates: map[string]interface{}{
+				"status":        status,
+				"current_order": 0,
+			},
+		}
+	}
+	return nil
+}
+
+type orderFix struct {
+	problem string
+	fix     string
+	// Make operator busy with order
+	attach bool
+	// Move order to dropped status
+	drop bool
+}
+
+// Checks active order against its operator, operator is nil if it does not exist
+func diagnoseOrder(order Order, op *Operator) *orderFix {
+	if !isActiveOrderStatus(order.Status) {
+		return nil
+	}
+	if op != nil && op.Status == proto.OperatorStatus_Busy && op.CurrentOrder == order.ID {
+		return nil
+	}
+
+	var ret orderFix
+	switch {
+	case op == nil:
+		ret.problem = fmt.Sprintf("order in status '%v' without operator", order.Status)
+	case op.Status == proto.OperatorStatus_Busy:
+		ret.problem = fmt.Sprintf("operator is busy with order %v", op.CurrentOrder)
+	default:
+		ret.problem = fmt.Sprintf("operator is %v", op.Status)
+	}
+	switch {
+	case op != nil && op.Status != proto.OperatorStatus_Busy:
+		ret.attach = true
+		ret.fix = "attach order to operator"
+	case order.Status == proto.OrderStatus_Accepted:
+		ret.drop = true
+		ret.fix = "drop order"
+	default:
+		ret.fix = "needs manual resolution"
+	}
+	return &ret
+}
+
+// Loads order or returns nil if it does not exist
+func loadReconciledOrder(scope *gorm.DB, id uint64) (*Order, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	var order Order
+	err := scope.First(&order, "id = ?", id).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// Loads operator or returns nil if it does not exist
+func loadReconciledOperator(scope *gorm.DB, id uint64) (*Operator, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	var op Operator
+	err := scope.First(&op, "id = ?", id).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// Checks every operator and active order, fixes found issues unless dryRun is set
+func reconcile(dryRun bool) (reconcileReport, error) {
+	report := reconcileReport{DryRun: dryRun}
+
+	var ops []Operator
+	err := db.New().Order("id").Find(&ops, "status IN (?)",
+		[]proto.OperatorStatus{proto.OperatorStatus_Proposal, proto.OperatorStatus_Busy},
+	).Error
+	if err != nil {
+		return report, fmt.Errorf("failed to load operators: %v", err)
+	}
+	for _, op := range ops {
+		order, err := loadReconciledOrder(db.New(), op.CurrentOrder)
+		if err != nil {
+			return report, fmt.Errorf("failed to load order %v: %v", op.CurrentOrder, err)
+		}
+		fix := diagnoseOperator(op, order)
+		if fix == nil {
+			continue
+		}
+		issue := reconcileIssue{
+			OperatorID: op.ID,
+			OrderID:    op.CurrentOrder,
+			Problem:    fix.problem,
+			Fix:        fix.fix,
+		}
+		if !dryRun {
+			issue.Fixed, issue.Err = fixOperator(op.ID)
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	var orders []Order
+	err = db.New().Order("id").Find(&orders, "status IN (?)", activeOrderStatuses).Error
+	if err != nil {
+		return report, fmt.Errorf("failed to load orders: %v", err)
+	}
+	for _, order := range orders {
+		op, err := loadReconciledOperator(db.New(), order.OperatorID)
+		if err != nil {
+			return report, fmt.Errorf("failed to load operator %v: %v", order.OperatorID, err)
+		}
+		fix := diagnoseOrder(order, op)
+		if fix == nil {
+			continue
+		}
+		issue := reconcileIssue{
+			OperatorID: order.OperatorID,
+			OrderID:    order.ID,
+			Problem:    fix.problem,
+			Fix:        fix.fix,
+		}
+		if !dryRun && (fix.attach || fix.drop) {
+			issue.Fixed, issue.Err = fixOrder(order.ID)
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	return report, nil
+}
+
+// Fixes operator if issue is still present under lock. Order is locked first as everywhere else.
+func fixOperator(operatorID uint64) (bool, error) {
+	op, err := loadReconciledOperator(db.New(), operatorID)
+	if err != nil || op == nil {
+		return false, err
+	}
+
+	tx := db.NewTransaction()
+	order, err := loadReconciledOrder(tx.Set("gorm:query_option", "FOR UPDATE"), op.CurrentOrder)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	locked, err := LockLoadOperatorByID(tx, operatorID)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if locked.CurrentOrder != op.CurrentOrder {
+		tx.Rollback()
+		return false, errors.New("operator was changed concurrently")
+	}
+
+	fix := diagnoseOperator(locked, order)
+	if fix == nil {
+		tx.Rollback()
+		return false, nil
+	}
+	err = tx.Model(&locked).Updates(fix.updates).Error
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	err = tx.Commit().Error
+	return err == nil, err
+}
+
+// Fixes order if issue is still present under lock
+func fixOrder(orderID uint64) (bool, error) {
+	tx := db.NewTransaction()
+	order, err := LockLoadOrderByID(tx, orderID)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	op, err := loadReconciledOperator(tx.Set("gorm:query_option", "FOR UPDATE"), order.OperatorID)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	fix := diagnoseOrder(order, op)
+	switch {
+	case fix == nil:
+		tx.Rollback()
+		return false, nil
+	case fix.attach:
+		err = tx.Model(op).Updates(map[string]interface{}{
+			"status":        proto.OperatorStatus_Busy,
+			"current_order": order.ID,
+		}).Error
+	case fix.drop:
+		order.Status = proto.OrderStatus_Dropped
+		err = order.Save(tx, ReconcileActor, fix.problem)
+	default:
+		tx.Rollback()
+		return false, nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	err = tx.Commit().Error
+	return err == nil, err
+}
+
+// Runs reconciliation, logs report and sends it to telegram chanel if something was found
+func runReconcile() {
+	report, err := reconcile(false)
+	if err != nil {
+		log.Errorf("failed to reconcile: %v", err)
+	}
+	if len(report.Issues) == 0 {
+		return
+	}
+	log.Warn(fmt.Sprint(report))
+	err = SendTelegramNotify(conf.TelegramChanel, report.String(), true)
+	if err != nil {
+		log.Errorf("failed to send reconciliation report: %v", err)
+	}
+}
+
+func ReconcileLoop() {
+	for range time.Tick(conf.ReconcileTick) {
+		runReconcile()
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"github.com/shopspring/decimal"
 	"lbapi"
 	"strconv"
-	tg "telegram/proto"
 	"time"
 )
 
@@ -22,8 +21,14 @@ func init() {
 	rabbit.ServeRPC(proto.SetOperatorStatus, SetOperatorStatus)
 	rabbit.ServeRPC(proto.SetOperatorKey, SetOperatorKey)
 	rabbit.ServeRPC(proto.GetDepositRefillAddress, GetDepositRefillAddress)
+	rabbit.ServeRPC(proto.GetDepositLedger, GetDepositLedger)
+	rabbit.ServeRPC(proto.RequestWithdrawal, RequestWithdrawal)
+	rabbit.ServeRPC(proto.GetQuote, GetQuote)
+	rabbit.ServeRPC(proto.GetOrderLimits, GetOrderLimits)
+	rabbit.ServeRPC(proto.ListPaymentMethods, ListPaymentMethods)
 	rabbit.ServeRPC(proto.CreateOrder, CreateOrder)
 	rabbit.ServeRPC(proto.GetOrder, GetOrder)
+	rabbit.ServeRPC(proto.GetOrderHistory, GetOrderHistory)
 	rabbit.ServeRPC(proto.AcceptOffer, AcceptOffer)
 	rabbit.ServeRPC(proto.SkipOffer, SkipOffer)
 	rabbit.ServeRPC(proto.DropOrder, DropOrder)
@@ -32,10 +37,15 @@ func init() {
 	rabbit.ServeRPC(proto.CancelOrder, CancelOrder)
 	rabbit.ServeRPC(proto.MarkPayed, MarkPayed)
 	rabbit.ServeRPC(proto.ConfirmPayment, ConfirmPayment)
+	rabbit.ServeRPC(proto.OpenDispute, OpenDispute)
+	rabbit.ServeRPC(proto.GetFeeTierStatus, GetFeeTierStatus)
+	rabbit.ServeRPC(proto.GetRates, GetRates)
 	rabbit.DeclareRPC(proto.BitsharesPayment, &ProcessPayment)
+	rabbit.DeclareRPC(proto.ValidateDestination, &validateDestinationRPC)
 }
 
 var ProcessPayment func(proto.BitsharesPaymentRequest) (proto.BitsharesPaymentResponse, error)
+var validateDestinationRPC func(name string) (proto.ValidateDestinationResponse, error)
 
 func GetDepositRefillAddress(operatorID uint64) (string, error) {
 	return ReceivingAddress, nil
@@ -116,7 +126,7 @@ func SetOperatorStatus(req proto.SetOperatorStatusRequest) (bool, error) {
 
 	if op.Status == proto.OperatorStatus_Busy {
 		tx.Rollback()
-		return false, errors.New("operator is busy")
+		return false, errors.New(proto.OperatorBusyError)
 	}
 	op.Status = req.Status
 	err = op.Save(tx)
@@ -297,24 +307,17 @@ func CreateOrder(req proto.Order) (proto.Order, error) {
 	if req.FiatAmount.Sign() <= 0 {
 		return proto.Order{}, errors.New("invalid fiat amount")
 	}
-	valid := false
-	for _, cur := range CurrencyList {
-		if cur == req.Currency {
-			valid = true
-			break
-		}
-	}
-	if !valid {
+	if !IsKnownCurrency(req.Currency) {
 		return proto.Order{}, errors.New("unknown currency")
 	}
-
-	node, err := GetExchangeRate(req.Currency)
+	if !IsKnownPaymentMethod(req.PaymentMethod, req.Currency) {
+		return proto.Order{}, errors.New("unknown payment method")
+	}
+	err := ValidateDestination(req.Destination)
 	if err != nil {
-		return proto.Order{}, errors.New("failed to determine exchange rate")
+		return proto.Order{}, err
 	}
 
-	// @TODO Check payment method
-	// @TODO Check destination
 	// @TODO Lock something on bitshares buffer? May be on later step
 	order := Order{
 		ClientName:    req.ClientName,
@@ -323,11 +326,48 @@ func CreateOrder(req proto.Order) (proto.Order, error) {
 		Currency:      req.Currency,
 		FiatAmount:    req.FiatAmount,
 		Status:        proto.OrderStatus_New,
-		// At this point it only determines required deposit. So we will refer to the best offer.
-		LBAmount: req.FiatAmount.Div(node.Minimal),
 	}
-	err = order.Save(db.New())
+
+	if req.QuoteID != 0 {
+		quote, err := LoadQuoteForOrder(db.New(), req.QuoteID, req)
+		if err != nil {
+			return proto.Order{}, err
+		}
+		order.QuoteID = quote.ID
+		order.LBAmount = quote.LBAmount
+		order.OperatorFee = quote.OperatorFee
+		order.BotFee = quote.BotFee
+		order.PricingRuleID = quote.PricingRuleID
+		order.RateSnapshotID = quote.RateSnapshotID
+		order.DerivedRate = quote.DerivedRate
+	} else {
+		price, err := PriceOrder(req.Currency, req.PaymentMethod, req.FiatAmount)
+		if err != nil {
+			return proto.Order{}, err
+		}
+		// At this point it only determines required deposit, fees are computed once contact is linked
+		order.LBAmount = price.LBAmount
+		order.PricingRuleID = price.RuleID
+		order.RateSnapshotID = price.RateSnapshotID
+		order.DerivedRate = price.DerivedRate
+	}
+
+	tx := db.NewTransaction()
+	err = CheckOrderLimits(tx, order)
+	if err != nil {
+		tx.Rollback()
+		return proto.Order{}, err
+	}
+
+	err = order.Save(tx, ClientActor(order.Destination), "created by client")
 	if err != nil {
+		tx.Rollback()
+		return proto.Order{}, errors.New(proto.DBError)
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		log.Errorf("failed to commit in CreateOrder: %v", err)
 		return proto.Order{}, errors.New(proto.DBError)
 	}
 
@@ -349,6 +389,32 @@ func GetOrder(id uint64) (proto.Order, error) {
 	return order.Encode(), nil
 }
 
+func GetDepositLedger(operatorID uint64) ([]proto.DepositEntry, error) {
+	ledger, err := LoadDepositLedger(db.New(), operatorID)
+	if err != nil {
+		log.Errorf("failed to load deposit ledger of operator %v: %v", operatorID, err)
+		return nil, errors.New(proto.DBError)
+	}
+	ret := make([]proto.DepositEntry, 0, len(ledger))
+	for _, entry := range ledger {
+		ret = append(ret, entry.Encode())
+	}
+	return ret, nil
+}
+
+func GetOrderHistory(orderID uint64) ([]proto.OrderHistoryRecord, error) {
+	history, err := LoadOrderHistory(db.New(), orderID)
+	if err != nil {
+		log.Errorf("failed to load history of order %v: %v", orderID, err)
+		return nil, errors.New(proto.DBError)
+	}
+	ret := make([]proto.OrderHistoryRecord, 0, len(history))
+	for _, record := range history {
+		ret = append(ret, record.Encode())
+	}
+	return ret, nil
+}
+
 func AcceptOffer(req proto.AcceptOfferRequest) (proto.Order, error) {
 	order, err := manager.AcceptOffer(req.OperatorID, req.OrderID)
 	return order.Encode(), err
@@ -425,7 +491,7 @@ func DropOrder(req proto.DropOrderRequest) (bool, error) {
 		return false, errors.New("unexpected status")
 	}
 
-	err = order.Save(tx)
+	err = order.Save(tx, OperatorActor(op.ID), "dropped by operator")
 	if err != nil {
 		tx.Rollback()
 		return false, errors.New(proto.DBError)
@@ -449,68 +515,147 @@ func DropOrder(req proto.DropOrderRequest) (bool, error) {
 	return true, nil
 }
 
-func LinkLBContract(req proto.LinkLBContractRequest) (proto.Order, error) {
-	if req.Requisites == "" {
-		return proto.Order{}, errors.New("empty requisites")
-	}
-
+func LinkLBContract(req proto.LinkLBContractRequest) (proto.LinkLBContractResponse, error) {
 	tx := db.NewTransaction()
 
 	order, err := LockLoadOrderByID(tx, req.OrderID)
 	if err != nil {
 		log.Errorf("failed to load order %v: %v", req.OrderID, err)
 		tx.Rollback()
-		return proto.Order{}, errors.New(proto.DBError)
+		return proto.LinkLBContractResponse{}, errors.New(proto.DBError)
 	}
 
 	if order.Status != proto.OrderStatus_Accepted && order.Status != proto.OrderStatus_Linked {
 		tx.Rollback()
-		return proto.Order{}, errors.New("unexpected status")
+		return proto.LinkLBContractResponse{}, errors.New("unexpected status")
+	}
+
+	// Requisites of already linked order
+	if req.ContactID == 0 && order.Status == proto.OrderStatus_Linked {
+		if req.Requisites == "" {
+			tx.Rollback()
+			return proto.LinkLBContractResponse{}, errors.New(proto.NoRequisitesError)
+		}
+		order.PaymentRequisites = req.Requisites
+		err = order.Save(tx, OperatorActor(order.OperatorID), "requisites changed")
+		if err != nil {
+			tx.Rollback()
+			return proto.LinkLBContractResponse{}, errors.New(proto.DBError)
+		}
+		err = tx.Commit().Error
+		if err != nil {
+			log.Errorf("failed to commit in LinkLBContact: %v", err)
+			return proto.LinkLBContractResponse{}, errors.New(proto.DBError)
+		}
+		return proto.LinkLBContractResponse{Order: order.Encode()}, nil
+	}
+
+	// Requisites are kept on order while operator chooses contact
+	requisites := req.Requisites
+	if requisites == "" {
+		requisites = order.PaymentRequisites
+	}
+	// Contact can be guessed only with requisites, explicit one can get them later
+	if requisites == "" && req.ContactID == 0 {
+		tx.Rollback()
+		return proto.LinkLBContractResponse{}, errors.New(proto.NoRequisitesError)
 	}
 
 	op, err := LockLoadOperatorByID(tx, order.OperatorID)
 	if err != nil {
 		log.Errorf("failed to load operator %v: %v", order.OperatorID, err)
 		tx.Rollback()
-		return proto.Order{}, errors.New(proto.DBError)
+		return proto.LinkLBContractResponse{}, errors.New(proto.DBError)
 	}
 
-	contacts, err := op.Key.ActiveContacts()
-	found := false
 	var contact lbapi.Contact
-	for _, contact = range contacts {
-		if contact.Data.Currency == order.Currency && contact.Data.Amount.Equal(order.FiatAmount) {
-			found = true
-			break
+	if req.ContactID != 0 {
+		contact, err = loadExplicitContact(tx, order, op, req.ContactID)
+		if err != nil {
+			tx.Rollback()
+			return proto.LinkLBContractResponse{Order: order.Encode()}, err
 		}
-	}
-	if !found {
-		tx.Rollback()
-		return order.Encode(), errors.New(proto.ContactNotFoundError)
+	} else {
+		contacts, err := op.Key.ActiveContacts()
+		if err != nil {
+			log.Errorf("failed to load active contacts of operator %v: %v", op.ID, err)
+		}
+		matched, err := matchLBContacts(tx, order, contacts)
+		if err != nil {
+			log.Errorf("failed to match contacts of order %v: %v", order.ID, err)
+			tx.Rollback()
+			return proto.LinkLBContractResponse{}, errors.New(proto.DBError)
+		}
+
+		switch {
+		case len(matched) == 0:
+			tx.Rollback()
+			return proto.LinkLBContractResponse{Order: order.Encode()}, errors.New(proto.ContactNotFoundError)
+
+		case len(matched) > 1:
+			err = tx.Model(&order).Update("payment_requisites", requisites).Error
+			if err != nil {
+				log.Errorf("failed to save requisites of order %v: %v", order.ID, err)
+				tx.Rollback()
+				return proto.LinkLBContractResponse{}, errors.New(proto.DBError)
+			}
+			err = tx.Commit().Error
+			if err != nil {
+				log.Errorf("failed to commit in LinkLBContact: %v", err)
+				return proto.LinkLBContractResponse{}, errors.New(proto.DBError)
+			}
+			return proto.LinkLBContractResponse{
+				Order:      order.Encode(),
+				Candidates: contactIDs(matched),
+			}, nil
+		}
+		contact = matched[0]
 	}
 
 	order.LBContactID = contact.Data.ContactID
 	order.LBAmount = contact.Data.AmountBTC
 	order.LBFee = contact.Data.FeeBTC
-	order.OperatorFee = order.LBAmount.Mul(decimal.NewFromFloat(conf.OperatorFee))
-	order.BotFee = order.LBAmount.Mul(decimal.NewFromFloat(conf.BotFee))
+	// Operator fee depends on tier of accepting operator, but quoted fee is kept as its upper bound.
+	// Pricing rule and bot fee of quoted order are fixed at order creation.
+	tierID, fee, err := operatorFeeRate(tx, op)
+	if err != nil {
+		log.Errorf("failed to load fee tier of operator %v: %v", op.ID, err)
+		tx.Rollback()
+		return proto.LinkLBContractResponse{}, errors.New(proto.DBError)
+	}
+	quotedFee := order.OperatorFee
+	order.FeeTierID = tierID
+	order.OperatorFee = order.LBAmount.Mul(fee)
+	if order.QuoteID != 0 && order.OperatorFee.Cmp(quotedFee) > 0 {
+		order.OperatorFee = quotedFee
+	}
+	if order.QuoteID == 0 {
+		rule, err := SelectPricingRule(tx, order.Currency, order.PaymentMethod, order.FiatAmount)
+		if err != nil {
+			log.Errorf("failed to select pricing rule for order %v: %v", order.ID, err)
+			tx.Rollback()
+			return proto.LinkLBContractResponse{}, errors.New(proto.DBError)
+		}
+		order.PricingRuleID = rule.ID
+		order.BotFee = rule.BotFee(order.LBAmount)
+	}
 	order.Status = proto.OrderStatus_Linked
-	order.PaymentRequisites = req.Requisites
+	order.PaymentRequisites = requisites
 
-	err = order.Save(tx)
+	err = order.Save(tx, OperatorActor(op.ID), fmt.Sprintf("linked to lb contact %v", order.LBContactID))
 	if err != nil {
 		log.Errorf("failed to save order: %v", err)
 		tx.Rollback()
-		return proto.Order{}, errors.New(proto.DBError)
+		return proto.LinkLBContractResponse{}, errors.New(proto.DBError)
 	}
 
 	err = tx.Commit().Error
 	if err != nil {
 		log.Errorf("failed to commit in LinkLBContact: %v", err)
-		return order.Encode(), errors.New(proto.DBError)
+		return proto.LinkLBContractResponse{Order: order.Encode()}, errors.New(proto.DBError)
 	}
 
-	return order.Encode(), nil
+	return proto.LinkLBContractResponse{Order: order.Encode()}, nil
 }
 
 func RequestPayment(orderID uint64) (proto.Order, error) {
@@ -521,9 +666,14 @@ func RequestPayment(orderID uint64) (proto.Order, error) {
 		tx.Rollback()
 		return proto.Order{}, errors.New(proto.DBError)
 	}
+	// Client can not pay without requisites
+	if order.PaymentRequisites == "" {
+		tx.Rollback()
+		return proto.Order{}, errors.New(proto.NoRequisitesError)
+	}
 	order.Status = proto.OrderStatus_Payment
 	order.PaymentRequestedAt = time.Now()
-	err = order.Save(tx)
+	err = order.Save(tx, OperatorActor(order.OperatorID), "payment requested")
 	if err != nil {
 		tx.Rollback()
 		return proto.Order{}, errors.New(proto.DBError)
@@ -558,6 +708,7 @@ func CancelOrder(orderID uint64) (bool, error) {
 		return false, errors.New("unexpected status")
 	}
 	order.Status = proto.OrderStatus_Canceled
+	order.CanceledBy = proto.ActorKind_Client
 
 	if order.OperatorID != 0 {
 		op, err := LockLoadOperatorByID(tx, order.OperatorID)
@@ -603,29 +754,28 @@ func CancelOrder(orderID uint64) (bool, error) {
 		}
 	}
 
-	err = order.Save(tx)
+	err = order.Save(tx, ClientActor(order.Destination), "canceled by client")
 	if err != nil {
 		log.Debug("failed to save order: %v", err)
 		tx.Rollback()
 		return false, errors.New(proto.DBError)
 	}
 
-	err = tx.Commit().Error
-	if err != nil {
-		log.Errorf("failed to commit in CancelOrder: %v", err)
-		return false, errors.New(proto.DBError)
-	}
-
 	if newOrder {
-		err = rabbit.Publish("offer_event", "", tg.OfferEvent{
-			Chats: chats,
-			Order: order.Encode(),
-		})
+		err = enqueueOfferEvent(tx, chats, order)
 		if err != nil {
 			log.Errorf("failed to send reject offer event: %v", err)
+			tx.Rollback()
+			return false, errors.New(proto.DBError)
 		}
 	}
 
+	err = tx.Commit().Error
+	if err != nil {
+		log.Errorf("failed to commit in CancelOrder: %v", err)
+		return false, errors.New(proto.DBError)
+	}
+
 	return true, nil
 }
 
@@ -646,7 +796,7 @@ func MarkPayed(orderID uint64) (bool, error) {
 	}
 	order.Status = proto.OrderStatus_Confirmation
 	order.MarkedPayedAt = time.Now()
-	err = order.Save(tx)
+	err = order.Save(tx, ClientActor(order.Destination), "marked payed by client")
 	if err != nil {
 		log.Debug("failed to save order: %v", err)
 		tx.Rollback()
@@ -676,6 +826,12 @@ func ConfirmPayment(orderID uint64) (bool, error) {
 		return false, errors.New("unexpected status")
 	}
 
+	return confirmOrder(tx, order, OperatorActor(order.OperatorID))
+}
+
+// Writes-off operator deposit, releases operator and transfers bitshares to client.
+// Commits or rollbacks passed transaction.
+func confirmOrder(tx *gorm.DB, order Order, actor Actor) (bool, error) {
 	op, err := LockLoadOperatorByID(tx, order.OperatorID)
 	if err != nil {
 		log.Errorf("failed to load operator %v: %v", order.OperatorID, err)
@@ -683,9 +839,16 @@ func ConfirmPayment(orderID uint64) (bool, error) {
 		return false, errors.New(proto.DBError)
 	}
 
-	// Amount to write-off from op deposit: contact_sum - lb_fee - op_fee
-	amount := order.LBAmount.Sub(order.LBFee).Sub(order.OperatorFee)
-	err = op.ChangeDeposit(tx, amount.Neg())
+	entry := DepositEntry{
+		Type:    proto.DepositEntryType_Order,
+		Amount:  order.WriteOffAmount().Neg(),
+		OrderID: order.ID,
+	}
+	if order.DisputeVerdict == proto.DisputeVerdict_Split {
+		entry.Comment = fmt.Sprintf("dispute split, settled part %v of %v BTC, operator fee %v",
+			order.DisputeClientPart, order.LBAmount, order.SettledOperatorFee())
+	}
+	_, err = op.ChangeDeposit(tx, entry)
 	if err != nil {
 		log.Errorf("failed to write-off: %v", err)
 		tx.Rollback()
@@ -702,63 +865,25 @@ func ConfirmPayment(orderID uint64) (bool, error) {
 		return false, errors.New(proto.DBError)
 	}
 
-	return finishOrder(tx, order)
+	return finishOrder(tx, order, actor)
 }
 
-func finishOrder(tx *gorm.DB, order Order) (bool, error) {
-	var telegramStatusMessage string = ""
-
-	response, err := ProcessPayment(proto.BitsharesPaymentRequest{
-		Name:   order.Destination,
-		Amount: order.OutletAmount(),
-	})
-
+// Moves order to transfer status and writes payout to outbox, transfer itself is made by payout dispatcher
+func finishOrder(tx *gorm.DB, order Order, actor Actor) (bool, error) {
+	order.Status = proto.OrderStatus_Transfer
+	order.ConfirmedAt = time.Now()
+	err := order.Save(tx, actor, "payment confirmed")
 	if err != nil {
-		order.Status = proto.OrderStatus_Transfer
-		order.ConfirmedAt = time.Now()
-
-		telegramStatusMessage = "Payment service unavailable, need to transfer manualy !"
-
-		errSave := order.Save(tx)
-
-		if errSave != nil {
-			log.Errorf("failed to save order: %v", errSave)
-			tx.Rollback()
-			return false, errors.New(proto.DBError)
-		}
-	}
-
-	if response.Success {
-		order.Status = proto.OrderStatus_Finished
-		order.ConfirmedAt = time.Now()
-
-		err = order.Save(tx)
-		if err != nil {
-			log.Errorf("failed to save order: %v", err)
-			tx.Rollback()
-			return false, errors.New(proto.DBError)
-		}
-	} else {
-		order.Status = proto.OrderStatus_Transfer
-		order.ConfirmedAt = time.Now()
-
-		telegramStatusMessage = fmt.Sprintf("Need manual transfer : %s", response.Message)
-
-		err = order.Save(tx)
-		if err != nil {
-			log.Errorf("failed to save order: %v", err)
-			tx.Rollback()
-			return false, errors.New(proto.DBError)
-		}
+		log.Errorf("failed to save order: %v", err)
+		tx.Rollback()
+		return false, errors.New(proto.DBError)
 	}
 
-	err = SendTelegramNotify(conf.TelegramChanel, fmt.Sprintf(
-		"Order %v reached transfer status\naccount: %v\namount: %v \n%v",
-		order.ID, order.Destination, order.OutletAmount(), telegramStatusMessage,
-	), true)
+	err = createPayout(tx, order)
 	if err != nil {
-		log.Errorf("failed to send fransfer notify: %v", err)
-		return false, errors.New("notify failed")
+		log.Errorf("failed to create payout for order %v: %v", order.ID, err)
+		tx.Rollback()
+		return false, errors.New(proto.DBError)
 	}
 
 	err = tx.Commit().Error
@@ -766,6 +891,23 @@ func finishOrder(tx *gorm.DB, order Order) (bool, error) {
 		log.Errorf("failed to commit in ConfirmPayment: %v", err)
 		return false, errors.New(proto.DBError)
 	}
+	kickPayouts()
+	// Completed volume of operator is changed
+	go func() {
+		err := updateFeeTier(order.OperatorID)
+		if err != nil {
+			log.Errorf("failed to update fee tier of operator %v: %v", order.OperatorID, err)
+		}
+	}()
 
+	go func() {
+		err := SendTelegramNotify(conf.TelegramChanel, fmt.Sprintf(
+			"Order %v reached transfer status\naccount: %v\namount: %v",
+			order.ID, order.Destination, order.PayoutAmount(),
+		), true)
+		if err != nil {
+			log.Errorf("failed to send fransfer notify: %v", err)
+		}
+	}()
 	return true, nil
 }
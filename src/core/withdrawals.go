@@ -0,0 +1,270 @@
+package main
+
+import (
+	"common/db"
+	"common/log"
+	"core/proto"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+func RequestWithdrawal(req proto.RequestWithdrawalRequest) (proto.Withdrawal, error) {
+	if req.Amount.Sign() <= 0 {
+		return proto.Withdrawal{}, errors.New("invalid amount")
+	}
+	if req.Address == "" {
+		return proto.Withdrawal{}, errors.New("empty address")
+	}
+
+	tx := db.NewTransaction()
+	op, err := LockLoadOperatorByID(tx, req.OperatorID)
+	if err != nil {
+		log.Errorf("failed to load operator %v: %v", req.OperatorID, err)
+		tx.Rollback()
+		return proto.Withdrawal{}, errors.New(proto.DBError)
+	}
+	if op.Status == proto.OperatorStatus_Busy || op.Status == proto.OperatorStatus_Proposal {
+		tx.Rollback()
+		return proto.Withdrawal{}, errors.New(proto.OperatorBusyError)
+	}
+
+	available, err := op.AvailableDeposit(tx)
+	if err != nil {
+		log.Errorf("failed to load pending withdrawals of operator %v: %v", op.ID, err)
+		tx.Rollback()
+		return proto.Withdrawal{}, errors.New(proto.DBError)
+	}
+	if available.Cmp(req.Amount) < 0 {
+		tx.Rollback()
+		return proto.Withdrawal{}, errors.New(proto.LackOfDepositError)
+	}
+
+	w := Withdrawal{
+		OperatorID: op.ID,
+		Amount:     req.Amount,
+		Address:    req.Address,
+		Status:     proto.WithdrawalStatus_Pending,
+	}
+	err = tx.Create(&w).Error
+	if err != nil {
+		log.Errorf("failed to save withdrawal: %v", err)
+		tx.Rollback()
+		return proto.Withdrawal{}, errors.New(proto.DBError)
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		log.Errorf("failed to commit in RequestWithdrawal: %v", err)
+		return proto.Withdrawal{}, errors.New(proto.DBError)
+	}
+
+	go func() {
+		err := SendTelegramNotify(conf.TelegramChanel, fmt.Sprintf(
+			"Operator %v(%v) requested withdrawal %v of %v BTC",
+			op.ID, op.Username, w.ID, w.Amount,
+		), true)
+		if err != nil {
+			log.Errorf("failed to send withdrawal notify: %v", err)
+		}
+	}()
+
+	return w.Encode(), nil
+}
+
+// Sends withdrawal from buffer account and writes it to deposit ledger.
+// Sending status is committed before send, so withdrawal can't be approved twice. If send fails
+// or its result can't be saved, withdrawal stays in sending status until admin resolves it.
+func approveWithdrawal(withdrawalID uint64, actor Actor) error {
+	tx := db.NewTransaction()
+	w, err := LockLoadWithdrawalByID(tx, withdrawalID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load withdrawal: %v", err)
+	}
+	if w.Status != proto.WithdrawalStatus_Pending {
+		tx.Rollback()
+		return fmt.Errorf("withdrawal have unexpected status '%v'", w.Status)
+	}
+
+	op, err := LockLoadOperatorByID(tx, w.OperatorID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load operator: %v", err)
+	}
+	if op.Status == proto.OperatorStatus_Busy || op.Status == proto.OperatorStatus_Proposal {
+		tx.Rollback()
+		return errors.New(proto.OperatorBusyError)
+	}
+	// This withdrawal is pending itself, so deposit is enough while available part is not negative
+	available, err := op.AvailableDeposit(tx)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load pending withdrawals: %v", err)
+	}
+	if available.Sign() < 0 {
+		tx.Rollback()
+		return errors.New(proto.LackOfDepositError)
+	}
+
+	w.Status = proto.WithdrawalStatus_Sending
+	w.Admin = actor.Name
+	err = tx.Save(&w).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save withdrawal: %v", err)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+
+	err = conf.LBKey.WalletSend(w.Address, w.Amount)
+	if err != nil {
+		// Request could reach lb even if it failed, so only admin can tell whether coins were sent
+		log.Errorf("failed to send withdrawal %v of %v BTC to %v: %v", w.ID, w.Amount, w.Address, err)
+		saveErr := db.New().Model(&w).Update("message", err.Error()).Error
+		if saveErr != nil {
+			log.Errorf("failed to save error of withdrawal %v: %v", w.ID, saveErr)
+		}
+		notifyWithdrawalStuck(w, err)
+		return fmt.Errorf("send failed, check lb wallet and resolve withdrawal manually: %v", err)
+	}
+
+	err = finishWithdrawal(w.ID, actor)
+	if err != nil {
+		log.Errorf("withdrawal %v of %v BTC to %v was sent, but was not saved: %v", w.ID, w.Amount, w.Address, err)
+		notifyWithdrawalStuck(w, err)
+		return fmt.Errorf("withdrawal was sent, but was not saved, mark it sent manually: %v", err)
+	}
+	return nil
+}
+
+// Marks sending withdrawal as sent and writes it to deposit ledger
+func finishWithdrawal(withdrawalID uint64, actor Actor) error {
+	tx := db.NewTransaction()
+	w, err := LockLoadWithdrawalByID(tx, withdrawalID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load withdrawal: %v", err)
+	}
+	if w.Status != proto.WithdrawalStatus_Sending {
+		tx.Rollback()
+		return fmt.Errorf("withdrawal have unexpected status '%v'", w.Status)
+	}
+	op, err := LockLoadOperatorByID(tx, w.OperatorID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load operator: %v", err)
+	}
+
+	w.Status = proto.WithdrawalStatus_Sent
+	w.SentAt = time.Now()
+	w.Message = ""
+	err = tx.Save(&w).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save withdrawal: %v", err)
+	}
+	_, err = op.ChangeDeposit(tx, DepositEntry{
+		Type:         proto.DepositEntryType_Withdrawal,
+		Amount:       w.Amount.Neg(),
+		WithdrawalID: w.ID,
+		Admin:        actor.Name,
+		Comment:      w.Address,
+	})
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to write-off deposit: %v", err)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := SendTelegramNotify(strconv.FormatInt(op.TelegramChat, 10), fmt.Sprintf(
+			M("withdrawal of %v BTC to %v was sent"), w.Amount, w.Address,
+		), true)
+		if err != nil {
+			log.Errorf("failed to send withdrawal notify: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Returns sending withdrawal to pending after admin made sure it was not sent
+func returnWithdrawal(withdrawalID uint64, actor Actor) error {
+	tx := db.NewTransaction()
+	w, err := LockLoadWithdrawalByID(tx, withdrawalID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load withdrawal: %v", err)
+	}
+	if w.Status != proto.WithdrawalStatus_Sending {
+		tx.Rollback()
+		return fmt.Errorf("withdrawal have unexpected status '%v'", w.Status)
+	}
+	w.Status = proto.WithdrawalStatus_Pending
+	w.Admin = actor.Name
+	err = tx.Save(&w).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save withdrawal: %v", err)
+	}
+	return tx.Commit().Error
+}
+
+func notifyWithdrawalStuck(w Withdrawal, err error) {
+	go func() {
+		err := SendTelegramNotify(conf.TelegramChanel, fmt.Sprintf(
+			"Withdrawal %v of %v BTC to %v is stuck in sending status, check lb wallet: %v",
+			w.ID, w.Amount, w.Address, err,
+		), true)
+		if err != nil {
+			log.Errorf("failed to send withdrawal notify: %v", err)
+		}
+	}()
+}
+
+func rejectWithdrawal(withdrawalID uint64, actor Actor) error {
+	tx := db.NewTransaction()
+	w, err := LockLoadWithdrawalByID(tx, withdrawalID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load withdrawal: %v", err)
+	}
+	if w.Status != proto.WithdrawalStatus_Pending {
+		tx.Rollback()
+		return fmt.Errorf("withdrawal have unexpected status '%v'", w.Status)
+	}
+
+	op, err := LockLoadOperatorByID(tx, w.OperatorID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load operator: %v", err)
+	}
+
+	w.Status = proto.WithdrawalStatus_Rejected
+	w.Admin = actor.Name
+	err = tx.Save(&w).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save withdrawal: %v", err)
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := SendTelegramNotify(strconv.FormatInt(op.TelegramChat, 10), fmt.Sprintf(
+			M("withdrawal of %v BTC to %v was rejected"), w.Amount, w.Address,
+		), false)
+		if err != nil {
+			log.Errorf("failed to send withdrawal notify: %v", err)
+		}
+	}()
+	return nil
+}
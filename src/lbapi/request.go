@@ -245,6 +245,35 @@ func (key Key) CurrencyList() (ret []string, err error) {
 	return ret, nil
 }
 
+type PaymentMethod struct {
+	// "QIWI"/"SPECIFIC_BANK"/etc, same as Advertisement.OnlineProvider
+	Code string `json:"code"`
+	Name string `json:"name"`
+	// Currencies which can be used with method. Empty list means any currency(can happen for international ones)
+	Currencies []string `json:"currencies"`
+	// Key for url of ads list of method
+	Key string `json:"key"`
+}
+
+func (key Key) PaymentMethods() (ret []PaymentMethod, err error) {
+	var result struct {
+		Methods map[string]PaymentMethod `json:"methods"`
+		Count   uint64                   `json:"method_count"`
+	}
+	_, err = key.DecodedRequest("GET", "/api/payment_methods/", "", &result)
+	if err != nil {
+		return ret, err
+	}
+	ret = make([]PaymentMethod, 0, len(result.Methods))
+	for code, method := range result.Methods {
+		if method.Code == "" {
+			method.Code = code
+		}
+		ret = append(ret, method)
+	}
+	return ret, nil
+}
+
 func (key Key) BuyOnlineList(currency string) ([]Advertisement, error) {
 	var ret []Advertisement
 	uri := fmt.Sprintf("/buy-bitcoins-online/%s/.json", currency)
@@ -330,6 +359,19 @@ func (key Key) NewAddress() (string, error) {
 	return result.Address, err
 }
 
+// Sends bitcoins from wallet to address.
+// Requires "money" permission for the key.
+func (key Key) WalletSend(address string, amount decimal.Decimal) error {
+	data := url.Values{}
+	data.Set("address", address)
+	data.Set("amount", amount.String())
+	var result struct {
+		Message string `json:"message"`
+	}
+	_, err := key.DecodedRequest("POST", "/api/wallet-send/", data.Encode(), &result)
+	return err
+}
+
 type Account struct {
 	Username                  string    `json:"username"`
 	CreatedAt                 time.Time `json:"created_at"`
@@ -431,6 +473,41 @@ func (key Key) contactsList(baseURL string) ([]Contact, error) {
 	return ret, nil
 }
 
+var contactDomains = []string{"localbitcoins.net", "localbitcoins.com"}
+
+// Checks that host is one of lb domains or their subdomain
+func isContactHost(host string) bool {
+	for _, d := range contactDomains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Extracts contact id from contact url (like https://localbitcoins.net/request/online_sell_buyer/123)
+// or explicit reference like #123, returns false if passed string is not a reference to contact.
+// Plain numbers are not accepted, they are card or phone numbers most likely.
+func ParseContactID(ref string) (uint64, bool) {
+	ref = strings.TrimSpace(ref)
+	if u, err := url.Parse(ref); err == nil && u.Host != "" {
+		if !isContactHost(u.Host) {
+			return 0, false
+		}
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		ref = parts[len(parts)-1]
+	} else if strings.HasPrefix(ref, "#") {
+		ref = strings.TrimPrefix(ref, "#")
+	} else {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(ref, 10, 64)
+	if err != nil || id == 0 {
+		return 0, false
+	}
+	return id, true
+}
+
 func (key Key) ContactInfo(contactID uint64) (Contact, error) {
 	var ret Contact
 	// @TODO We will not get "actions" in this way,
@@ -1,6 +1,7 @@
 const { key, TransactionBuilder } = require('bitsharesjs');
 const { Apis } = require('bitsharesjs-ws');
 const rabbit = require('amqplib');
+const fs = require('fs');
 
 
 function bail(err) {
@@ -35,61 +36,153 @@ const connectNode = async (urls) => {
   return false;
 }
 
+// Journal of transfers by payout id, appended and synced on every change, so transfer with the same
+// payout id is never made twice. 'started' is written before broadcast, so transfer interrupted
+// by crash stays uncertain and is left to admin: if transfer is absent in account history,
+// admin appends 'failed' record for the payout id, so it can be retried.
+const openJournal = (path) => {
+  const states = {};
+  if (fs.existsSync(path)) {
+    fs.readFileSync(path, 'utf8').split('\n').forEach((line) => {
+      if (!line) {
+        return;
+      }
+      try {
+        const record = JSON.parse(line);
+        states[record.id] = record.state;
+      } catch (err) {
+        console.error('Skipping broken journal line', line);
+      }
+    });
+  }
+  const fd = fs.openSync(path, 'a');
+
+  return {
+    state: (id) => states[id],
+    write: (id, state) => {
+      fs.writeSync(fd, JSON.stringify({ id, state, at: new Date().toISOString() }) + '\n');
+      fs.fsyncSync(fd);
+      states[id] = state;
+    },
+  };
+}
+
 const initPayer = (config) => {
   const normalizedBrainkey = key.normalize_brainKey(config.bitshares.brainkey);
   const privateKey = key.get_brainPrivateKey(normalizedBrainkey, 1);
+  const journal = openJournal(config.payouts.journal);
+  // Payout ids being processed right now
+  const inFlight = new Set();
+
+  const transfer = async (payoutId, username, amount) => {
+    switch (journal.state(payoutId)) {
+      case 'sent':
+        return { success: true, alreadySent: true };
+      case 'started':
+        return { success: false, uncertain: true, message: 'previous transfer was interrupted, check account history' };
+    }
 
-  return async (username, amount) => {
     const connected = await connectNode(config.bitshares.nodes);
     if (!connected) {
-      return { success: false, error: 'cant connect to any node'};
+      return { success: false, message: 'cant connect to any node'};
     }
 
     const precisedAmount = parseFloat(amount).toFixed(8) * (10 ** 8);
 
-    console.log("\nTransfer ", amount, precisedAmount, ' to ', username);
+    console.log("\nTransfer ", payoutId, amount, precisedAmount, ' to ', username);
 
-    const toAccount = await Apis.instance().db_api().exec('get_account_by_name', [username]);
-    const transaction = await getTransaction(precisedAmount, toAccount.id, config.bitshares.userid, privateKey)
+    let transaction;
+    try {
+      const toAccount = await Apis.instance().db_api().exec('get_account_by_name', [username]);
+      if (!toAccount) {
+        return { success: false, message: 'account not found' };
+      }
+      transaction = await getTransaction(precisedAmount, toAccount.id, config.bitshares.userid, privateKey)
+    } catch (error) {
+      return { success: false, message: error.message }
+    }
 
+    journal.write(payoutId, 'started');
     try {
       const result = await transaction.broadcast();
+      journal.write(payoutId, 'sent');
       return { success: true }
     } catch (error) {
+      journal.write(payoutId, 'failed');
       return { success: false, message: error.message }
     }
   }
+
+  return async ({ PayoutID: payoutId, Name: username, Amount: amount }) => {
+    if (!payoutId) {
+      return { success: false, message: 'empty payout id' };
+    }
+    if (inFlight.has(payoutId)) {
+      return { success: false, uncertain: true, message: 'transfer with this payout id is in progress' };
+    }
+    inFlight.add(payoutId);
+    try {
+      return await transfer(payoutId, username, amount);
+    } finally {
+      inFlight.delete(payoutId);
+    }
+  }
 }
 
-const initRabbit = async (url, callback) => {
+// Answers bitshares_validate_destination rpc of core: whether bitshares account with such name exists
+const initValidator = (config) => {
+  return async (username) => {
+    const connected = await connectNode(config.bitshares.nodes);
+    if (!connected) {
+      return { Exists: false, Unavailable: true, Message: 'cant connect to any node' };
+    }
+
+    try {
+      const account = await Apis.instance().db_api().exec('get_account_by_name', [username]);
+      if (!account) {
+        return { Exists: false, Message: 'account not found' };
+      }
+      return { Exists: true };
+    } catch (error) {
+      return { Exists: false, Unavailable: true, Message: error.message };
+    }
+  }
+}
+
+// Serves rpc declared in core proto, callback gets decoded request and returns response
+const serveRPC = async (channel, name, callback) => {
+  const queueName = '__rpc__' + name;
+
+  channel.assertExchange(queueName, 'fanout', {durable: false, autoDelete: true});
+
+  channel.assertQueue(queueName, { durable: false, autoDelete: true });
+
+  await channel.bindQueue(queueName, queueName, '');
+
+  channel.consume(queueName, async (msg) => {
+    const payload = JSON.parse(msg.content.toString());
+
+    const result = await callback(payload);
+    const output = JSON.stringify(result);
+
+    channel.sendToQueue(
+      msg.properties.replyTo,
+      new Buffer(output),
+      {correlationId: msg.properties.correlationId}
+    );
+    channel.ack(msg);
+  });
+}
+
+const initRabbit = async (url, handlers) => {
   try {
     const connection = await rabbit.connect(url);
     const channel = await connection.createChannel();
-    const queueName = '__rpc__bitshares_transfer';
-    
-    channel.assertExchange(queueName, 'fanout', {durable: false, autoDelete: true});
 
-    channel.assertQueue(queueName, { durable: false, autoDelete: true });
-      
-    const res =  await channel.bindQueue(queueName, queueName, '');
+    for (const name of Object.keys(handlers)) {
+      await serveRPC(channel, name, handlers[name]);
+    }
     console.log('Worker Up - Awaiting RPC requests');
-
-    channel.consume(queueName, async (msg) => {
-      const payload = JSON.parse(msg.content.toString());
-
-      const username = payload.Name;
-      const amount = payload.Amount;
-      
-      const result = await callback(username, amount);
-      const output = JSON.stringify(result);
-
-      channel.sendToQueue(
-        msg.properties.replyTo,
-        new Buffer(output),
-        {correlationId: msg.properties.correlationId}
-      );
-      channel.ack(msg);
-    });
   } catch (err) {
     bail(err)
   }
@@ -98,8 +191,10 @@ const initRabbit = async (url, callback) => {
 
 const processWork = async (config) => {
   try {
-    const paymentCallback = initPayer(config);
-    initRabbit(config.rabbit.URL, paymentCallback);
+    initRabbit(config.rabbit.URL, {
+      bitshares_transfer: initPayer(config),
+      bitshares_validate_destination: initValidator(config),
+    });
   } catch (err) {
     bail(err);
   }
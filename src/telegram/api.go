@@ -15,10 +15,13 @@ var AcceptOffer func(proto.AcceptOfferRequest) (proto.Order, error)
 var SkipOffer func(proto.SkipOfferRequest) (bool, error)
 var GetOrder func(id uint64) (proto.Order, error)
 var DropOrder func(proto.DropOrderRequest) (bool, error)
-var LinkLBContact func(proto.LinkLBContractRequest) (proto.Order, error)
+var LinkLBContact func(proto.LinkLBContractRequest) (proto.LinkLBContractResponse, error)
 var RequestPayment func(orderID uint64) (proto.Order, error)
 var ConfirmPayment func(orderID uint64) (bool, error)
+var OpenDispute func(proto.OpenDisputeRequest) (proto.Order, error)
 var GetDepositRefillAddress func(operatorID uint64) (string, error)
+var GetFeeTierStatus func(operatorID uint64) (proto.FeeTierStatus, error)
+var RequestWithdrawal func(proto.RequestWithdrawalRequest) (proto.Withdrawal, error)
 
 func init() {
 	rabbit.DeclareRPC(proto.CheckKey, &CheckKey)
@@ -33,5 +36,8 @@ func init() {
 	rabbit.DeclareRPC(proto.LinkLBContact, &LinkLBContact)
 	rabbit.DeclareRPC(proto.RequestPayment, &RequestPayment)
 	rabbit.DeclareRPC(proto.ConfirmPayment, &ConfirmPayment)
+	rabbit.DeclareRPC(proto.OpenDispute, &OpenDispute)
 	rabbit.DeclareRPC(proto.GetDepositRefillAddress, &GetDepositRefillAddress)
+	rabbit.DeclareRPC(proto.GetFeeTierStatus, &GetFeeTierStatus)
+	rabbit.DeclareRPC(proto.RequestWithdrawal, &RequestWithdrawal)
 }
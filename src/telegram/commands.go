@@ -4,6 +4,7 @@ import (
 	"common/log"
 	"core/proto"
 	"fmt"
+	"github.com/shopspring/decimal"
 	"github.com/tucnak/telebot"
 	"time"
 )
@@ -17,7 +18,7 @@ var commands = map[string]MessageHandler{}
 func AddCommand(command string, handler MessageHandler) {
 	_, ok := commands[command]
 	if ok {
-		log.Warn("commad '%v' is already registed, replacing")
+		log.Warn(fmt.Sprintf("commad '%v' is already registed, replacing", command))
 	}
 	commands[command] = handler
 }
@@ -25,7 +26,9 @@ func AddCommand(command string, handler MessageHandler) {
 func init() {
 	AddCommand("/help", helpHandler)
 	AddCommand("/deposit", depositHandler)
+	AddCommand("/status", statusHandler)
 	AddCommand("/reload", reloadHandler)
+	AddCommand("/withdraw", withdrawHandler)
 }
 
 func helpHandler(s *Session, _ *telebot.Message) {
@@ -60,6 +63,45 @@ func depositHandler(s *Session, _ *telebot.Message) {
 	)
 }
 
+// Shows fee tier of operator and conditions of the next one
+func statusHandler(s *Session, _ *telebot.Message) {
+	if s.Operator.ID == 0 {
+		log.Error(SendMessage(s.Dest(), M("related account not fould"), nil))
+		return
+	}
+	status, err := GetFeeTierStatus(s.Operator.ID)
+	if err != nil {
+		log.Errorf("failed to load fee tier of operator %v: %v", s.Operator.ID, err)
+		s.ChangeState(State_Unavailable)
+		return
+	}
+	percent := decimal.New(100, 0)
+	text := fmt.Sprintf(
+		M("your fee tier is %v, fee %v%%\ncompleted volume for last 30 days: %v BTC"),
+		status.Tier, status.Fee.Mul(percent), status.MonthlyVolume,
+	)
+	if status.NextTier != "" {
+		text += "\n\n" + fmt.Sprintf(
+			M("next tier is %v with fee %v%%, it requires volume of %v BTC and %v days with us"),
+			status.NextTier, status.NextFee.Mul(percent), status.NextVolume, status.NextTenureDays,
+		)
+	}
+	log.Error(SendMessage(s.Dest(), text, nil))
+}
+
+func withdrawHandler(s *Session, _ *telebot.Message) {
+	if s.Operator.ID == 0 {
+		log.Error(SendMessage(s.Dest(), M("related account not fould"), nil))
+		return
+	}
+	// Withdrawal is not allowed while operator is serving orders anyway
+	if s.State != State_Start {
+		log.Error(SendMessage(s.Dest(), M("stop service before withdrawal"), nil))
+		return
+	}
+	s.ChangeState(State_Withdraw)
+}
+
 // Timeout between actual attempts to reload session
 const ReloadTimeout = 3 * time.Second
 
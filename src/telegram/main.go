@@ -6,6 +6,7 @@ import (
 	"common/log"
 	"common/rabbit"
 	"common/stopper"
+	"fmt"
 	"github.com/tucnak/telebot"
 	"sync"
 	"time"
@@ -128,7 +129,7 @@ func Listen() {
 			if session != nil {
 				session.PushEvent(event.Data)
 			} else {
-				log.Warn("could to get session for operator %v/chat %v", event.OperatorID, event.ChatID)
+				log.Warn(fmt.Sprintf("could to get session for operator %v/chat %v", event.OperatorID, event.ChatID))
 			}
 		}
 	}
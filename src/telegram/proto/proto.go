@@ -30,6 +30,8 @@ var SendNotifyRoute = rabbit.Route{
 }
 
 type OfferEvent struct {
+	// Sequence number of event among events of order
+	Seq   uint64
 	Chats []int64
 	Order core.Order
 }
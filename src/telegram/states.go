@@ -5,6 +5,7 @@ import (
 	"common/rabbit"
 	"core/proto"
 	"fmt"
+	"github.com/shopspring/decimal"
 	"github.com/tucnak/telebot"
 	"lbapi"
 	"strconv"
@@ -20,6 +21,7 @@ const (
 	State_InterruptedAction
 	State_WaitForOrders
 	State_ServeOrder
+	State_Withdraw
 )
 
 var stateString = map[State]string{
@@ -30,6 +32,7 @@ var stateString = map[State]string{
 	State_InterruptedAction: "InterruptedAction",
 	State_WaitForOrders:     "WaitForOrders",
 	State_ServeOrder:        "ServeOrder",
+	State_Withdraw:          "Withdraw",
 }
 
 func (s State) String() string {
@@ -93,6 +96,11 @@ var statesInit = map[State]StateActions{
 		Message: serveOrderStateMessage,
 		Event:   serveOrderStateEvent,
 	},
+
+	State_Withdraw: {
+		Enter:   withdrawStateEnter,
+		Message: withdrawStateMessage,
+	},
 }
 
 func startStateEnter(s *Session, loaded bool) {
@@ -393,7 +401,7 @@ func waitForOrdersStateEvent(s *Session, event interface{}) {
 		s.context = nil
 
 	default:
-		log.Warn("got order %v with unxepected status %v in WaitForOrders", order.ID, order.Status)
+		log.Warn(fmt.Sprintf("got order %v with unxepected status %v in WaitForOrders", order.ID, order.Status))
 		if s.context == nil {
 			return
 		}
@@ -430,23 +438,22 @@ func serveOrderStateEnter(s *Session, loaded bool) {
 		log.Error(SendMessage(s.Dest(), fmt.Sprintf(M("create lb"), order.FiatAmount, order.Currency, order.PaymentMethod), Keyboard(M("drop"))))
 
 	case proto.OrderStatus_Linked:
-		log.Error(SendMessage(s.Dest(), fmt.Sprintf(
-			M("lb link: %v\ncontact amount: %v\nrequsites:\n%v"),
-			fmt.Sprintf("https://localbitcoins.net/request/online_sell_buyer/%v", order.LBContractID),
-			order.LBAmount, order.PaymentRequisites,
-		), Keyboard(M("confirm"), M("drop"))))
+		sendLinkedOrder(s, order)
 
 	case proto.OrderStatus_Payment:
 		log.Error(SendMessage(s.Dest(), "wait for payment", Keyboard("...")))
 
 	case proto.OrderStatus_Confirmation:
-		log.Error(SendMessage(s.Dest(), fmt.Sprintf(M("order payed"), order.ID), Keyboard(M("confirm"))))
+		log.Error(SendMessage(s.Dest(), fmt.Sprintf(M("order payed"), order.ID), Keyboard(M("confirm"), M("dispute"))))
 
 	case proto.OrderStatus_ConfirmationExtended:
 		log.Error(SendMessage(s.Dest(),
 			M("confirmation timeout is exceeded, you can drop order now"),
-			Keyboard(M("confirm"), M("drop")),
+			Keyboard(M("confirm"), M("drop"), M("dispute")),
 		))
+
+	case proto.OrderStatus_Disputed:
+		log.Error(SendMessage(s.Dest(), fmt.Sprintf(M("order %v is disputed, wait for admin decision"), order.ID), Keyboard("...")))
 	}
 }
 
@@ -470,11 +477,11 @@ func serveOrderStateEvent(s *Session, event interface{}) {
 		// Does not matter, that is result of our accept actuality
 
 	case proto.OrderStatus_Canceled:
-		log.Error(SendMessage(
-			s.Dest(),
-			fmt.Sprintf(M("Sorry! Client canceled order #%v"), order.ID),
-			Keyboard(M("cancel")),
-		))
+		text := M("Sorry! Client canceled order #%v")
+		if order.CanceledBy == proto.ActorKind_LB {
+			text = M("lb contact of order %v was canceled")
+		}
+		log.Error(SendMessage(s.Dest(), fmt.Sprintf(text, order.ID), Keyboard(M("cancel"))))
 		s.ChangeState(State_WaitForOrders)
 
 	case proto.OrderStatus_Timeout:
@@ -490,30 +497,39 @@ func serveOrderStateEvent(s *Session, event interface{}) {
 		s.context = order
 
 	case proto.OrderStatus_Confirmation:
-		log.Error(SendMessage(s.Dest(), fmt.Sprintf(M("order payed"), order.ID), Keyboard(M("confirm"))))
+		log.Error(SendMessage(s.Dest(), fmt.Sprintf(M("order payed"), order.ID), Keyboard(M("confirm"), M("dispute"))))
 		s.context = order
 
 	case proto.OrderStatus_ConfirmationExtended:
 		log.Error(SendMessage(s.Dest(),
 			M("confirmation timeout is exceeded, you can drop order now"),
-			Keyboard(M("confirm"), M("drop")),
+			Keyboard(M("confirm"), M("drop"), M("dispute")),
 		))
 		s.context = order
 
 	case proto.OrderStatus_Unconfirmed:
 		s.ChangeState(State_WaitForOrders)
 
+	case proto.OrderStatus_Disputed:
+		if curOrder.Status != proto.OrderStatus_Disputed {
+			log.Error(SendMessage(s.Dest(), fmt.Sprintf(M("order %v is disputed, wait for admin decision"), order.ID), Keyboard("...")))
+		}
+		s.context = order
+
+	case proto.OrderStatus_PayoutFailed:
+		// operator part of order is done already, payout is up to admins
+
 	case proto.OrderStatus_Transfer, proto.OrderStatus_Finished:
-		amount := order.LBAmount.Sub(order.LBFee).Sub(order.OperatorFee)
+		// Fee and write-off are scaled if dispute was split
 		log.Error(SendMessage(
 			s.Dest(),
-			fmt.Sprintf(M("order finished"), order.ID, order.OperatorFee, amount, order.LBAmount),
+			fmt.Sprintf(M("order finished"), order.ID, order.SettledOperatorFee, order.WriteOffAmount, order.LBAmount),
 			Keyboard(M("confirm")),
 		))
 		s.ChangeState(State_WaitForOrders)
 
 	default:
-		log.Warn("got order %v with unxepected status %v in WaitForOrders", order.ID, order.Status)
+		log.Warn(fmt.Sprintf("got order %v with unxepected status %v in WaitForOrders", order.ID, order.Status))
 		if s.context == nil {
 			return
 		}
@@ -530,6 +546,21 @@ func serveOrderStateEvent(s *Session, event interface{}) {
 	}
 }
 
+// Sends contact info of linked order or asks requisites if they were not passed yet
+func sendLinkedOrder(s *Session, order proto.Order) {
+	if order.PaymentRequisites == "" {
+		log.Error(SendMessage(s.Dest(), fmt.Sprintf(
+			M("order linked to lb contact %v, send payment requisites"), order.LBContractID,
+		), Keyboard(M("drop"))))
+		return
+	}
+	log.Error(SendMessage(s.Dest(), fmt.Sprintf(
+		M("lb link: %v\ncontact amount: %v\nrequsites:\n%v"),
+		fmt.Sprintf("https://localbitcoins.net/request/online_sell_buyer/%v", order.LBContractID),
+		order.LBAmount, order.PaymentRequisites,
+	), Keyboard(M("confirm"), M("drop"))))
+}
+
 func serveOrderStateMessage(s *Session, msg *telebot.Message) {
 	order, ok := s.context.(proto.Order)
 	if !ok {
@@ -551,38 +582,70 @@ func serveOrderStateMessage(s *Session, msg *telebot.Message) {
 		s.ChangeState(State_WaitForOrders)
 		return
 	}
+	if msg.Text == M("dispute") {
+		ret, err := OpenDispute(proto.OpenDisputeRequest{
+			OrderID:    order.ID,
+			OperatorID: s.Operator.ID,
+			Reason:     "operator did not receive payment",
+		})
+		if err != nil {
+			log.Errorf("failed to dispute order %v: %v", order.ID, err)
+			s.ChangeState(State_Unavailable)
+			return
+		}
+		s.context = ret
+		log.Error(SendMessage(s.Dest(), fmt.Sprintf(M("order %v is disputed, wait for admin decision"), order.ID), Keyboard("...")))
+		return
+	}
 	switch order.Status {
 	case proto.OrderStatus_Linked:
 		if msg.Text == M("confirm") {
-			order, err := RequestPayment(order.ID)
-			if err != nil {
+			ret, err := RequestPayment(order.ID)
+			switch {
+			case err == nil:
+				s.context = ret
+				log.Error(SendMessage(s.Dest(), M("wait for payment"), Keyboard("...")))
+			case err.Error() == proto.NoRequisitesError:
+				sendLinkedOrder(s, order)
+			default:
 				s.ChangeState(State_Unavailable)
-				return
 			}
-			s.context = order
-			log.Error(SendMessage(s.Dest(), M("wait for payment"), Keyboard("...")))
 			return
 		}
 		fallthrough
 
 	case proto.OrderStatus_Accepted:
-		ret, err := LinkLBContact(proto.LinkLBContractRequest{
+		// Contact url or #id links accepted order to that contact, anything else is requisites.
+		// Contact of accepted order is guessed by requisites then.
+		// Linked order already has contact, so text is always requisites there.
+		req := proto.LinkLBContractRequest{
 			OrderID:    order.ID,
 			Requisites: msg.Text,
-		})
+		}
+		if id, ok := lbapi.ParseContactID(msg.Text); ok && order.Status == proto.OrderStatus_Accepted {
+			req.Requisites = ""
+			req.ContactID = id
+		}
+		ret, err := LinkLBContact(req)
 		switch {
+		case err == nil && len(ret.Candidates) > 0:
+			keys := make([]string, 0, len(ret.Candidates)+1)
+			for _, id := range ret.Candidates {
+				keys = append(keys, fmt.Sprintf("#%v", id))
+			}
+			keys = append(keys, M("drop"))
+			log.Error(SendMessage(s.Dest(), M("several lb contacts match order, choose one"), Keyboard(keys...)))
+
 		case err == nil:
-			order = ret
+			order = ret.Order
 			s.context = order
-			log.Error(SendMessage(s.Dest(), fmt.Sprintf(
-				M("lb link: %v\ncontact amount: %v\nrequsites:\n%v"),
-				fmt.Sprintf("https://localbitcoins.net/request/online_sell_buyer/%v", order.LBContractID),
-				order.LBAmount, order.PaymentRequisites,
-			), Keyboard(M("confirm"), M("drop"))))
+			sendLinkedOrder(s, order)
 
 		// @TODO Do we need a way to exchange without contact?
 		case err.Error() == proto.ContactNotFoundError:
 			log.Error(SendMessage(s.Dest(), M("related lb contact not found"), Keyboard(M("drop"))))
+		case err.Error() == proto.ContactMismatchError:
+			log.Error(SendMessage(s.Dest(), M("lb contact does not match order"), Keyboard(M("drop"))))
 		default:
 			log.Errorf("failed to link lb contact for order %v: %v", order.ID, err)
 			s.ChangeState(State_Unavailable)
@@ -601,7 +664,7 @@ func serveOrderStateMessage(s *Session, msg *telebot.Message) {
 			}
 			return
 		}
-		log.Error(SendMessage(s.Dest(), fmt.Sprintf(M("order payed"), order.ID), Keyboard(M("confirm"))))
+		log.Error(SendMessage(s.Dest(), fmt.Sprintf(M("order payed"), order.ID), Keyboard(M("confirm"), M("dispute"))))
 
 	case proto.OrderStatus_ConfirmationExtended:
 		switch msg.Text {
@@ -615,18 +678,65 @@ func serveOrderStateMessage(s *Session, msg *telebot.Message) {
 			return
 
 		// handled above
-		//case "drop":
+		//case "drop", "dispute":
 
 		default:
 			log.Error(SendMessage(s.Dest(),
 				M("confirmation timeout is exceeded, you can drop order now"),
-				Keyboard(M("confirm"), M("drop")),
+				Keyboard(M("confirm"), M("drop"), M("dispute")),
 			))
 		}
 
+	case proto.OrderStatus_Disputed:
+		log.Error(SendMessage(s.Dest(), fmt.Sprintf(M("order %v is disputed, wait for admin decision"), order.ID), Keyboard("...")))
+
 	default:
 		s.ChangeState(State_Unavailable)
 	}
 
 	return
 }
+
+func withdrawStateEnter(s *Session, loaded bool) {
+	log.Error(SendMessage(s.Dest(), M("input withdrawal amount"), Keyboard(M("cancel"))))
+}
+
+func withdrawStateMessage(s *Session, msg *telebot.Message) {
+	if msg.Text == M("cancel") {
+		s.ChangeState(State_Start)
+		return
+	}
+	if s.context == nil {
+		amount, err := decimal.NewFromString(msg.Text)
+		if err != nil || amount.Sign() <= 0 {
+			log.Error(SendMessage(s.Dest(), M("invalid amount"), Keyboard(M("cancel"))))
+			return
+		}
+		s.context = amount
+		log.Error(SendMessage(s.Dest(), M("input withdrawal address"), Keyboard(M("cancel"))))
+		return
+	}
+
+	// We have amount already, so it's address now.
+	amount := s.context.(decimal.Decimal)
+	w, err := RequestWithdrawal(proto.RequestWithdrawalRequest{
+		OperatorID: s.Operator.ID,
+		Amount:     amount,
+		Address:    msg.Text,
+	})
+	switch {
+	case err == nil:
+		log.Error(SendMessage(s.Dest(), fmt.Sprintf(
+			M("withdrawal %v of %v BTC to %v is waiting for approve"), w.ID, w.Amount, w.Address,
+		), nil))
+
+	case err.Error() == proto.LackOfDepositError, err.Error() == proto.OperatorBusyError:
+		log.Error(SendMessage(s.Dest(), M(err.Error()), nil))
+
+	default:
+		log.Errorf("failed to request withdrawal for operator %v: %v", s.Operator.ID, err)
+		s.ChangeState(State_Unavailable)
+		return
+	}
+	s.ChangeState(State_Start)
+}
@@ -48,8 +48,16 @@ func SendNotifyHandler(notify proto.SendNotifyMessage) bool {
 	return true
 }
 
+var (
+	offerEvents = core.NewEventSequencer(10000)
+	orderEvents = core.NewEventSequencer(10000)
+)
+
 func OfferEventHandler(e proto.OfferEvent) bool {
 	log.Debug("offer event: %+v", e)
+	if offerEvents.Stale(e.Order.ID, e.Seq) {
+		return true
+	}
 	for _, chat := range e.Chats {
 		global.events <- event{
 			ChatID: chat,
@@ -61,6 +69,9 @@ func OfferEventHandler(e proto.OfferEvent) bool {
 
 func OrderEventHandler(order core.Order) bool {
 	log.Debug("order event: %+v", order)
+	if orderEvents.Stale(order.ID, order.EventSeq) {
+		return true
+	}
 	if order.OperatorID == 0 {
 		// Ignore such events
 		return true